@@ -0,0 +1,418 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// Error messages
+var (
+	errAuthReq   = errors.New("authentication required")
+	errAuthFail  = errors.New("authentication failed")
+	errAuthPhase = errors.New("auth protocol phase error")
+	errAuthFid   = errors.New("operation not permitted on auth fid")
+	errAuthProto = errors.New("unsupported auth protocol")
+)
+
+// AuthProto is an authentication protocol run on the auth fid of a client
+// (see Tauth): a new conversation is started for each auth fid.
+type AuthProto interface {
+	// Name of the protocol (as announced in p9any)
+	Name() string
+
+	// New starts the server side of a conversation with a client that
+	// wants to attach as the given user.
+	New(user string) (AuthConv, error)
+}
+
+// AuthConv is the server side of an authentication conversation. Messages
+// are exchanged by the client reading and writing its auth fid.
+type AuthConv interface {
+	// Read returns the next message for the client. It returns an error
+	// if the conversation expects a message from the client.
+	Read() ([]byte, error)
+
+	// Write processes a message from the client. Messages can be written
+	// in parts; an error aborts the conversation.
+	Write(p []byte) error
+
+	// User returns the authenticated user (or an empty string if the
+	// conversation hasn't succeeded yet).
+	User() string
+}
+
+// SetAuth requires clients to authenticate with the given protocol before
+// they can attach to the namespace. The setting applies to connections
+// served after the call; nil disables authentication.
+func (ns *Namespace) SetAuth(proto AuthProto) {
+	ns.gmtx.Lock()
+	defer ns.gmtx.Unlock()
+	ns.auth = proto
+}
+
+// authProto returns the configured authentication protocol (or nil).
+func (ns *Namespace) authProto() AuthProto {
+	ns.gmtx.Lock()
+	defer ns.gmtx.Unlock()
+	return ns.auth
+}
+
+//----------------------------------------------------------------------
+
+// authFid is an auth fid of a connection.
+type authFid struct {
+	conv AuthConv // authentication conversation
+	user string   // user requesting authentication
+	qid  ninep.Qid
+	out  []byte // pending output for the client
+	err  error  // conversation failed
+}
+
+// authFilter handles the auth related messages of a connection if
+// authentication is configured: auth fids are managed by the connection
+// (ninep rejects Tauth) and attach requests require an authenticated
+// auth fid for the user. Returns true if the request has been handled.
+func (c *conn) authFilter(frame []byte) (bool, error) {
+	tag := binary.LittleEndian.Uint16(frame[5:])
+	body := frame[hdrSize:]
+	if len(body) < 4 {
+		return true, c.error(tag, errMsg)
+	}
+	fid := binary.LittleEndian.Uint32(body)
+	switch frame[4] {
+	case msgTauth:
+		// afid[4] uname[s] aname[s]
+		user, _, err := getStr(body[4:])
+		if err != nil {
+			return true, c.error(tag, err)
+		}
+		if _, ok := c.afids[fid]; ok {
+			return true, c.error(tag, errAuthPhase)
+		}
+		conv, err := c.auth.New(user)
+		if err != nil {
+			return true, c.error(tag, err)
+		}
+		c.apath++
+		a := &authFid{
+			conv: conv,
+			user: user,
+			qid:  ninep.Qid{Type: ninep.QTAuth, Path: c.apath},
+		}
+		c.afids[fid] = a
+		return true, c.reply(msgRauth, tag, appendQid(nil, a.qid))
+
+	case msgTattach:
+		// fid[4] afid[4] uname[s] aname[s]
+		if len(body) < 8 {
+			return true, c.error(tag, errMsg)
+		}
+		user, _, err := getStr(body[8:])
+		if err != nil {
+			return true, c.error(tag, err)
+		}
+		a, ok := c.afids[binary.LittleEndian.Uint32(body[4:])]
+		if !ok {
+			return true, c.error(tag, errAuthReq)
+		}
+		if a.user != user || a.conv.User() != user {
+			return true, c.error(tag, errAuthFail)
+		}
+		return false, nil
+
+	case msgTversion, msgTflush:
+		return false, nil
+	}
+	a, ok := c.afids[fid]
+	if !ok {
+		return false, nil
+	}
+	switch frame[4] {
+	case msgTread:
+		// fid[4] offset[8] count[4]
+		if len(body) < 16 {
+			return true, c.error(tag, errMsg)
+		}
+		if len(a.out) == 0 && a.err == nil {
+			a.out, a.err = a.conv.Read()
+		}
+		if a.err != nil {
+			return true, c.error(tag, a.err)
+		}
+		n := min(len(a.out), int(binary.LittleEndian.Uint32(body[12:])))
+		b := binary.LittleEndian.AppendUint32(nil, uint32(n))
+		b = append(b, a.out[:n]...)
+		a.out = a.out[n:]
+		return true, c.reply(msgRread, tag, b)
+
+	case msgTwrite:
+		// fid[4] offset[8] count[4] data[count]
+		if len(body) < 16 {
+			return true, c.error(tag, errMsg)
+		}
+		data := body[16:]
+		if n := int(binary.LittleEndian.Uint32(body[12:])); n < len(data) {
+			data = data[:n]
+		}
+		if a.err == nil {
+			a.err = a.conv.Write(data)
+		}
+		if a.err != nil {
+			return true, c.error(tag, a.err)
+		}
+		return true, c.reply(msgRwrite, tag, binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+
+	case msgTclunk:
+		delete(c.afids, fid)
+		return true, c.reply(msgRclunk, tag, nil)
+
+	case msgTremove:
+		delete(c.afids, fid)
+		return true, c.error(tag, errPerm)
+	}
+	return true, c.error(tag, errAuthFid)
+}
+
+// getStr decodes a string and returns the remaining buffer.
+func getStr(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errMsg
+	}
+	n := int(binary.LittleEndian.Uint16(b)) + 2
+	if n > len(b) {
+		return "", nil, errMsg
+	}
+	return string(b[2:n]), b[n:], nil
+}
+
+//----------------------------------------------------------------------
+// Pre-shared key authentication ("psk"):
+//
+//   S->C: nonce_s[16]
+//   C->S: nonce_c[16] HMAC-SHA256(key, "client" nonce_s nonce_c user)
+//   S->C: HMAC-SHA256(key, "server" nonce_c nonce_s user)
+//
+// Both sides prove knowledge of the key shared by the user and the server.
+//----------------------------------------------------------------------
+
+// size of a nonce in the PSK protocol
+const pskNonce = 16
+
+// KeyFunc returns the key of a user (or nil if the user is unknown).
+type KeyFunc func(user string) []byte
+
+// pskProto is the pre-shared key protocol.
+type pskProto struct {
+	keys KeyFunc
+}
+
+// NewPSKAuth returns a challenge/response protocol for users with keys
+// shared with the server.
+func NewPSKAuth(keys KeyFunc) AuthProto {
+	return &pskProto{keys: keys}
+}
+
+// Name of the protocol
+func (p *pskProto) Name() string {
+	return "psk"
+}
+
+// New conversation for user.
+func (p *pskProto) New(user string) (AuthConv, error) {
+	conv := &pskConv{
+		key:   p.keys(user),
+		user:  user,
+		nonce: make([]byte, pskNonce),
+	}
+	rand.Read(conv.nonce)
+	conv.out = conv.nonce
+	return conv, nil
+}
+
+// pskConv is the server side of a PSK conversation.
+type pskConv struct {
+	key   []byte // key of user (nil if unknown)
+	user  string // user to authenticate
+	nonce []byte // server nonce
+	in    []byte // partial client message
+	out   []byte // next message for client
+	done  bool   // user authenticated
+}
+
+// Read the next message for the client.
+func (c *pskConv) Read() ([]byte, error) {
+	if c.out == nil {
+		return nil, errAuthPhase
+	}
+	out := c.out
+	c.out = nil
+	return out, nil
+}
+
+// Write a message from the client.
+func (c *pskConv) Write(p []byte) error {
+	if c.done || c.out != nil {
+		return errAuthPhase
+	}
+	if c.in = append(c.in, p...); len(c.in) < pskNonce+sha256.Size {
+		return nil
+	}
+	if len(c.in) > pskNonce+sha256.Size || c.key == nil {
+		return errAuthFail
+	}
+	peer := c.in[:pskNonce]
+	if !hmac.Equal(c.in[pskNonce:], pskMAC(c.key, "client", c.nonce, peer, c.user)) {
+		return errAuthFail
+	}
+	c.out = pskMAC(c.key, "server", peer, c.nonce, c.user)
+	c.done = true
+	return nil
+}
+
+// User returns the authenticated user.
+func (c *pskConv) User() string {
+	if !c.done {
+		return ""
+	}
+	return c.user
+}
+
+// pskMAC computes the proof of a party in the PSK protocol.
+func pskMAC(key []byte, role string, n1, n2 []byte, user string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	mac.Write(n1)
+	mac.Write(n2)
+	mac.Write([]byte(user))
+	return mac.Sum(nil)
+}
+
+//----------------------------------------------------------------------
+// Protocol negotiation ("p9any", version 2):
+//
+//   S->C: "v.2 proto@dom proto@dom...\0"
+//   C->S: "proto dom\0"
+//   S->C: "OK\0"
+//
+// followed by the conversation of the selected protocol.
+//----------------------------------------------------------------------
+
+// p9anyProto negotiates the protocol used for authentication.
+type p9anyProto struct {
+	dom    string
+	protos []AuthProto
+}
+
+// NewP9anyAuth returns a protocol that lets the client choose one of the
+// given protocols for the authentication domain dom (like Plan 9 p9any).
+func NewP9anyAuth(dom string, protos ...AuthProto) AuthProto {
+	return &p9anyProto{dom: dom, protos: protos}
+}
+
+// Name of the protocol
+func (p *p9anyProto) Name() string {
+	return "p9any"
+}
+
+// New conversation for user.
+func (p *p9anyProto) New(user string) (AuthConv, error) {
+	var offer []string
+	for _, proto := range p.protos {
+		offer = append(offer, proto.Name()+"@"+p.dom)
+	}
+	conv := &p9anyConv{
+		p:    p,
+		user: user,
+		out:  []byte("v.2 " + strings.Join(offer, " ") + "\x00"),
+	}
+	return conv, nil
+}
+
+// p9anyConv is the server side of a protocol negotiation.
+type p9anyConv struct {
+	p    *p9anyProto
+	user string   // user to authenticate
+	in   []byte   // partial client message
+	out  []byte   // next message for client
+	conv AuthConv // conversation of selected protocol
+}
+
+// Read the next message for the client.
+func (c *p9anyConv) Read() ([]byte, error) {
+	if c.out != nil {
+		out := c.out
+		c.out = nil
+		return out, nil
+	}
+	if c.conv == nil {
+		return nil, errAuthPhase
+	}
+	return c.conv.Read()
+}
+
+// Write a message from the client.
+func (c *p9anyConv) Write(p []byte) error {
+	if c.conv != nil {
+		return c.conv.Write(p)
+	}
+	if c.out != nil {
+		return errAuthPhase
+	}
+	c.in = append(c.in, p...)
+	end := bytes.IndexByte(c.in, 0)
+	if end < 0 {
+		return nil
+	}
+	name, dom, _ := strings.Cut(string(c.in[:end]), " ")
+	if dom != c.p.dom {
+		return errAuthProto
+	}
+	for _, proto := range c.p.protos {
+		if proto.Name() != name {
+			continue
+		}
+		conv, err := proto.New(c.user)
+		if err != nil {
+			return err
+		}
+		c.conv = conv
+		c.out = []byte("OK\x00")
+		return nil
+	}
+	return errAuthProto
+}
+
+// User returns the authenticated user.
+func (c *p9anyConv) User() string {
+	if c.conv == nil {
+		return ""
+	}
+	return c.conv.User()
+}
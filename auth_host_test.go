@@ -0,0 +1,142 @@
+//go:build host
+
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// p9sk1Login runs the client side of the p9sk1 protocol on an auth fid
+// with tickets from the auth server.
+func (c *testClient) p9sk1Login(afid uint32, user string, key []byte, as *AuthServer) error {
+	var cchal [chalLen]byte
+	rand.Read(cchal[:])
+	if _, err := c.write(afid, 0, cchal[:]); err != nil {
+		return err
+	}
+	buf, err := c.read(afid, 0, tickReqLen)
+	if err != nil {
+		return err
+	}
+	tr, err := parseTicketReq(buf)
+	if err != nil {
+		return err
+	}
+	tr.HostID, tr.UID = user, user
+
+	// get tickets from auth server
+	srv, cli := net.Pipe()
+	go as.ServeConn(srv)
+	if _, err = cli.Write(tr.Bytes()); err != nil {
+		return err
+	}
+	buf = make([]byte, 1+2*ticketLen)
+	if _, err = io.ReadFull(cli, buf[:1]); err != nil {
+		return err
+	}
+	if buf[0] != authOK {
+		return errAuthFail
+	}
+	if _, err = io.ReadFull(cli, buf[1:]); err != nil {
+		return err
+	}
+	tc, err := parseTicket(buf[1:1+ticketLen], key)
+	if err != nil {
+		return err
+	}
+	if tc.Num != authTc || tc.Chal != tr.Chal {
+		return errAuthFail
+	}
+	// send ticket and authenticator
+	a := &authenticator{Num: authAc, Chal: tr.Chal}
+	msg := append(buf[1+ticketLen:], a.Bytes(tc.Key)...)
+	if _, err = c.write(afid, 0, msg); err != nil {
+		return err
+	}
+	// check server authenticator
+	if buf, err = c.read(afid, 0, authentLen); err != nil {
+		return err
+	}
+	if a, err = parseAuthenticator(buf, tc.Key); err != nil {
+		return err
+	}
+	if a.Num != authAs || a.Chal != cchal {
+		return errAuthFail
+	}
+	return nil
+}
+
+func TestAuthP9any(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &AuthServer{
+		Dom: "srv9p",
+		Keys: map[string][]byte{
+			"sys":    PassToKey("server password"),
+			"glenda": PassToKey("glenda"),
+		},
+	}
+	psk := NewPSKAuth(func(string) []byte { return nil })
+	ns.SetAuth(NewP9anyAuth("srv9p", NewP9sk1Auth("sys", "srv9p", as.Keys["sys"]), psk))
+
+	login := func(user, passwd string) error {
+		t.Helper()
+		c := newTestConn(t, ns)
+		if _, err := c.auth(1, user); err != nil {
+			t.Fatal(err)
+		}
+		offer, err := c.read(1, 0, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(offer) != "v.2 p9sk1@srv9p psk@srv9p\x00" {
+			t.Fatalf("offer: %q", offer)
+		}
+		if _, err = c.write(1, 0, []byte("p9sk1 srv9p\x00")); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := c.read(1, 0, 3); err != nil || !bytes.Equal(ok, []byte("OK\x00")) {
+			t.Fatalf("negotiation: %q, %v", ok, err)
+		}
+		if err = c.p9sk1Login(1, user, PassToKey(passwd), as); err != nil {
+			return err
+		}
+		return c.attach(0, 1, user)
+	}
+	if err = login("glenda", "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if err = login("glenda", "wrong"); err == nil {
+		t.Fatal("login with wrong password")
+	}
+	if err = login("bootes", "glenda"); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("login of unknown user: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"testing"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// pskLogin runs the client side of the PSK protocol on an auth fid.
+func (c *testClient) pskLogin(afid uint32, user string, key []byte) error {
+	nonce, err := c.read(afid, 0, 8192)
+	if err != nil {
+		return err
+	}
+	peer := make([]byte, pskNonce)
+	rand.Read(peer)
+	msg := append(peer, pskMAC(key, "client", nonce, peer, user)...)
+	if _, err = c.write(afid, 0, msg); err != nil {
+		return err
+	}
+	proof, err := c.read(afid, 0, 8192)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, pskMAC(key, "server", peer, nonce, user)) {
+		return errAuthFail
+	}
+	return nil
+}
+
+func TestAuthPSK(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{
+		"glenda": []byte("glenda's secret"),
+	}
+	ns.SetAuth(NewPSKAuth(func(user string) []byte {
+		return keys[user]
+	}))
+	c := newTestConn(t, ns)
+	if err = c.attach(0, nofid, "glenda"); err == nil {
+		t.Fatal("attach without authentication")
+	}
+	// wrong key
+	if _, err = c.auth(1, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.pskLogin(1, "glenda", []byte("guess")); err == nil {
+		t.Fatal("login with wrong key")
+	}
+	if err = c.attach(0, 1, "glenda"); err == nil {
+		t.Fatal("attach with failed authentication")
+	}
+	if err = c.clunk(1); err != nil {
+		t.Fatal(err)
+	}
+	// valid key
+	qid, err := c.auth(1, "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qid.Type != ninep.QTAuth {
+		t.Fatalf("auth qid type %x", qid.Type)
+	}
+	if err = c.attach(0, 1, "glenda"); err == nil {
+		t.Fatal("attach before authentication")
+	}
+	if err = c.pskLogin(1, "glenda", keys["glenda"]); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.attach(0, 1, "sys"); err == nil {
+		t.Fatal("attach as other user")
+	}
+	if err = c.attach(0, 1, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(0, 2, "readme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(1, 3); err == nil {
+		t.Fatal("walk from auth fid")
+	}
+}
+
+func TestP9sk1Crypt(t *testing.T) {
+	key := PassToKey("a rather long password")
+	if len(key) != desKeyLen || bytes.Equal(key, PassToKey("a rather long passw0rd")) {
+		t.Fatalf("bad key %x", key)
+	}
+	for _, n := range []int{8, 13, 72, 141} {
+		plain := make([]byte, n)
+		rand.Read(plain)
+		buf := bytes.Clone(plain)
+		encrypt(key, buf)
+		if bytes.Equal(buf, plain) {
+			t.Fatalf("%d bytes not encrypted", n)
+		}
+		if err := decrypt(key, buf); err != nil || !bytes.Equal(buf, plain) {
+			t.Fatalf("%d bytes: decryption failed", n)
+		}
+	}
+}
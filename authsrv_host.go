@@ -0,0 +1,99 @@
+//go:build host
+
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+)
+
+// length of an error message from the auth server
+const authErrLen = 64
+
+// AuthServer is a stand-in for a Plan 9 auth server (for testing purposes):
+// it issues p9sk1 tickets for users with known keys. A user can only
+// request tickets for itself.
+type AuthServer struct {
+	Dom  string            // authentication domain
+	Keys map[string][]byte // DES keys of users (see PassToKey)
+}
+
+// Serve ticket requests on connections accepted by the listener.
+func (as *AuthServer) Serve(lst net.Listener) error {
+	for {
+		c, err := lst.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			as.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn answers a ticket request on a connection.
+func (as *AuthServer) ServeConn(rw io.ReadWriter) error {
+	buf := make([]byte, tickReqLen)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	tickets, err := as.tickets(buf)
+	if err != nil {
+		msg := make([]byte, 1+authErrLen)
+		msg[0] = authErr
+		copy(msg[1:authErrLen], err.Error())
+		_, werr := rw.Write(msg)
+		return errors.Join(err, werr)
+	}
+	_, err = rw.Write(append([]byte{authOK}, tickets...))
+	return err
+}
+
+// tickets returns the client and server tickets for a ticket request.
+func (as *AuthServer) tickets(buf []byte) ([]byte, error) {
+	r, err := parseTicketReq(buf)
+	if err != nil {
+		return nil, err
+	}
+	if r.Type != authTreq || r.AuthDom != as.Dom {
+		return nil, errAuthProto
+	}
+	kc, ks := as.Keys[r.HostID], as.Keys[r.AuthID]
+	if kc == nil || ks == nil || r.UID != r.HostID {
+		return nil, errAuthFail
+	}
+	t := &ticket{
+		Chal: r.Chal,
+		CUid: r.HostID,
+		SUid: r.UID,
+		Key:  make([]byte, desKeyLen),
+	}
+	rand.Read(t.Key)
+	t.Num = authTc
+	tickets := t.Bytes(kc)
+	t.Num = authTs
+	return append(tickets, t.Bytes(ks)...), nil
+}
@@ -0,0 +1,267 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"errors"
+	"slices"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// Bind flags (as in Plan 9)
+const (
+	MREPL   = 0 // replace the directory
+	MBEFORE = 1 // union: bound namespace before existing content
+	MAFTER  = 2 // union: bound namespace after existing content
+)
+
+// Error messages
+var (
+	errBind  = errors.New("bind cycle")
+	errBound = errors.New("namespace already bound")
+)
+
+// bound identifies an entry in a bound namespace.
+type bound struct {
+	ns   *Namespace // bound namespace
+	path uint64     // Qid.Path in bound namespace
+}
+
+//----------------------------------------------------------------------
+
+// Bind the root of another namespace to a directory. With MREPL the
+// directory content is replaced by the content of the bound namespace;
+// MBEFORE and MAFTER create a union directory that merges the content
+// of all bound namespaces and the directory itself in order (entries
+// found earlier hide entries with the same name found later). New entries
+// created by clients in a union directory are added to the first member
+// accepting them.
+//
+// Entries of bound namespaces get Qid paths of this namespace when they
+// are served to clients. Binds are only followed by 9p sessions and Get:
+// entries of a bound namespace are managed with its own methods. A
+// namespace can only be bound once (but can be rebound with MREPL to
+// the same directory).
+func (ns *Namespace) Bind(path string, sub *Namespace, flag int) error {
+	if sub == ns || sub.binds(ns) {
+		return errBind
+	}
+	e, err := ns.Get(path)
+	if err != nil {
+		return err
+	}
+	if !e.IsDir() {
+		return errNoDir
+	}
+	sub.mtx.RLock()
+	root := sub.dict[0]
+	sub.mtx.RUnlock()
+
+	defer ns.prune()
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if key, ok := ns.keys[root]; ok && (key != e || flag != MREPL) {
+		return errBound
+	}
+	list, ok := ns.mounts[e]
+	if !ok {
+		list = []*Entry{e}
+	}
+	switch flag {
+	case MREPL:
+		for _, m := range list {
+			delete(ns.keys, m)
+		}
+		list = []*Entry{root}
+	case MBEFORE:
+		list = append([]*Entry{root}, list...)
+	case MAFTER:
+		list = append(slices.Clip(list), root)
+	default:
+		return errPerm
+	}
+	ns.mounts[e] = list
+	ns.keys[root] = e
+	return nil
+}
+
+// Unbind removes all binds from a directory.
+func (ns *Namespace) Unbind(path string) error {
+	e, err := ns.Get(path)
+	if err != nil {
+		return err
+	}
+	defer ns.prune()
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if _, ok := ns.mounts[e]; !ok {
+		return errNoFile
+	}
+	ns.unmount(e)
+	return nil
+}
+
+// unmount removes the binds from a directory (namespace locked by caller).
+func (ns *Namespace) unmount(e *Entry) {
+	for _, m := range ns.mounts[e] {
+		delete(ns.keys, m)
+	}
+	delete(ns.mounts, e)
+}
+
+// binds returns true if the namespace (directly or indirectly) binds
+// another namespace.
+func (ns *Namespace) binds(other *Namespace) bool {
+	return slices.Contains(ns.mounted(), other)
+}
+
+// mounted returns the namespaces bound (directly or indirectly) by the
+// namespace.
+func (ns *Namespace) mounted() (subs []*Namespace) {
+	add := func(n *Namespace) {
+		n.mtx.RLock()
+		defer n.mtx.RUnlock()
+		for _, list := range n.mounts {
+			for _, m := range list {
+				if m.ns != ns && !slices.Contains(subs, m.ns) {
+					subs = append(subs, m.ns)
+				}
+			}
+		}
+	}
+	add(ns)
+	for i := 0; i < len(subs); i++ {
+		add(subs[i])
+	}
+	return
+}
+
+// prune drops the Qid paths assigned to entries of namespaces that are no
+// longer bound.
+func (ns *Namespace) prune() {
+	subs := ns.mounted()
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	for b, path := range ns.local {
+		if !slices.Contains(subs, b.ns) {
+			delete(ns.local, b)
+			delete(ns.alias, path)
+		}
+	}
+}
+
+// union returns the members of a union directory or the entry itself.
+// Binds of the namespace and of the namespace owning the entry are used.
+func (ns *Namespace) union(e *Entry) []*Entry {
+	for _, n := range []*Namespace{ns, e.ns} {
+		n.mtx.RLock()
+		list, ok := n.mounts[e]
+		n.mtx.RUnlock()
+		if ok {
+			return list
+		}
+	}
+	return []*Entry{e}
+}
+
+// view returns the union directory for a member (or the entry itself).
+func (ns *Namespace) view(e *Entry) *Entry {
+	for _, n := range []*Namespace{ns, e.ns} {
+		n.mtx.RLock()
+		key, ok := n.keys[e]
+		n.mtx.RUnlock()
+		if ok {
+			return key
+		}
+	}
+	return e
+}
+
+// next walks from a directory to the entry with given name, following
+// binds and refreshing dynamic directories. Returns nil if not found.
+func (ns *Namespace) next(e *Entry, name string) *Entry {
+	if !e.IsDir() {
+		return nil
+	}
+	if name == ".." {
+		e.ns.mtx.RLock()
+		c := e.ns.walk(e, name)
+		e.ns.mtx.RUnlock()
+		return ns.view(c)
+	}
+	for _, d := range ns.union(e) {
+		if d.refresh() != nil {
+			continue
+		}
+		d.ns.mtx.RLock()
+		c := d.ns.walk(d, name)
+		d.ns.mtx.RUnlock()
+		if c != nil {
+			return ns.view(c)
+		}
+	}
+	return nil
+}
+
+// lookup returns the entry for a Qid path (nil if not found).
+func (ns *Namespace) lookup(path uint64) *Entry {
+	ns.mtx.RLock()
+	e, ok := ns.dict[path]
+	b, bok := ns.alias[path]
+	ns.mtx.RUnlock()
+	if ok {
+		return e
+	}
+	if !bok {
+		return nil
+	}
+	b.ns.mtx.RLock()
+	defer b.ns.mtx.RUnlock()
+	return b.ns.dict[b.path]
+}
+
+// qid returns the Qid of an entry served by the namespace. Entries of bound
+// namespaces get Qid paths of the namespace.
+func (ns *Namespace) qid(e *Entry) ninep.Qid {
+	e.ns.mtx.RLock()
+	qid := e.ref.Qid
+	e.ns.mtx.RUnlock()
+	qid.Path = ns.path(e)
+	return qid
+}
+
+// path returns the Qid path of an entry served by the namespace.
+func (ns *Namespace) path(e *Entry) uint64 {
+	if e.ns == ns {
+		return e.ref.Path
+	}
+	b := bound{e.ns, e.ref.Path}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	path, ok := ns.local[b]
+	if !ok {
+		path = ns.newId()
+		ns.local[b] = path
+		ns.alias[path] = b
+	}
+	return path
+}
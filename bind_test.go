@@ -0,0 +1,215 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"slices"
+	"testing"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+func TestBind(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// feature module with its own namespace
+	dev := NewNamespace("sys", "sys")
+	if err = dev.NewFile("/temp", 0444, NewTextFile("21.5")); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.NewDir("/relay", 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.NewFile("/relay/ctl", 0666, NewMemFile(nil)); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := dev.Get("/")
+	root.ref.Mode = ninep.DMDir | 0775
+	root.SetCreator(func(name string, perm uint32) (File, error) {
+		return NewMemFile(nil), nil
+	})
+	if err = ns.NewDir("/dev", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/dev/hidden", 0444, &NopFile{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Bind("/dev", dev, MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Bind("/relay", ns, MREPL); err == nil {
+		t.Fatal("bind cycle accepted")
+	}
+	if e, err := ns.Get("/dev/relay/../temp"); err != nil || e.ns != dev {
+		t.Fatalf("get: %v", err)
+	}
+	c := newTestClient(t, ns, "sys")
+
+	// walk and read through the mount point
+	qids, err := c.walk(0, 1, "dev", "relay", "ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[uint64]bool)
+	for _, e := range ns.dict {
+		paths[e.ref.Path] = true
+	}
+	for _, qid := range qids[1:] {
+		if paths[qid.Path] {
+			t.Fatalf("Qid path %d not remapped", qid.Path)
+		}
+		paths[qid.Path] = true
+	}
+	if _, _, err = c.open(1, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.write(1, 0, []byte("on")); err != nil {
+		t.Fatal(err)
+	}
+	ctl, _ := dev.Get("/relay/ctl")
+	if data, _ := ctl.file.Read(); string(data) != "on" {
+		t.Fatalf("written: %q", data)
+	}
+	// walk back to the mount point and beyond
+	q, err := c.walk(0, 2, "dev", "relay", "..", "..", "readme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q[2] != qids[0] || q[4].Path != 1 {
+		t.Fatalf("walk back: %v", q)
+	}
+	if _, err = c.walk(0, 3, "dev", "hidden"); err == nil {
+		t.Fatal("replaced entry visible")
+	}
+	// stat of the mount point
+	if _, err = c.walk(0, 3, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.stat(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "dev" || d.Mode != ninep.DMDir|0775 || d.Path != qids[0].Path {
+		t.Fatalf("stat mount point: %+v", d)
+	}
+	// create in bound namespace
+	if _, err = c.create(3, "log", 0666, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dev.Get("/log"); err != nil {
+		t.Fatal(err)
+	}
+	// unbind
+	if err = ns.Unbind("/dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(0, 4, "dev", "temp"); err == nil {
+		t.Fatal("walk after unbind")
+	}
+	if _, err = c.walk(0, 4, "dev", "hidden"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ns.alias) != 0 || len(ns.local) != 0 {
+		t.Fatalf("aliases after unbind: %d/%d", len(ns.alias), len(ns.local))
+	}
+	// a namespace can only be bound once
+	if err = ns.Bind("/dev", dev, MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Bind("/dev", dev, MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Bind("/dev", dev, MAFTER); err != errBound {
+		t.Fatalf("double bind: %v", err)
+	}
+	if err = ns.Bind("/sensors", dev, MREPL); err != errBound {
+		t.Fatalf("double bind: %v", err)
+	}
+}
+
+func TestBindUnion(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewDir("/bin", 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/bin/ls", 0555, NewTextFile("local ls")); err != nil {
+		t.Fatal(err)
+	}
+	before := NewNamespace("sys", "sys")
+	if err = before.NewFile("/ls", 0555, NewTextFile("before ls")); err != nil {
+		t.Fatal(err)
+	}
+	if err = before.NewFile("/cat", 0555, NewTextFile("before cat")); err != nil {
+		t.Fatal(err)
+	}
+	after := NewNamespace("sys", "sys")
+	if err = after.NewFile("/cat", 0555, NewTextFile("after cat")); err != nil {
+		t.Fatal(err)
+	}
+	if err = after.NewFile("/date", 0555, NewTextFile("after date")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Bind("/bin", before, MBEFORE); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Bind("/bin", after, MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+
+	// listing merges all members
+	if _, err = c.walk(0, 1, "bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	names, err := c.list(1, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"cat", "date", "ls"}) {
+		t.Fatalf("listing: %v", names)
+	}
+	// walk finds first member
+	for i, tc := range [][2]string{
+		{"ls", "before ls"},
+		{"cat", "before cat"},
+		{"date", "after date"},
+	} {
+		fid := uint32(10 + i)
+		if _, err = c.walk(0, fid, "bin", tc[0]); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = c.open(fid, OREAD); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := c.read(fid, 0, 64); err != nil || string(data) != tc[1] {
+			t.Fatalf("read %s: %q, %v", tc[0], data, err)
+		}
+	}
+}
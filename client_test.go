@@ -0,0 +1,277 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// fid number for "no fid"
+const nofid = 0xffffffff
+
+// testClient is a minimal 9P client talking to a served namespace.
+type testClient struct {
+	t    testing.TB
+	conn net.Conn
+	tag  uint16
+}
+
+// newTestClient serves the namespace over a pipe and attaches to it
+// with fid 0 as the given user.
+func newTestClient(t testing.TB, ns *Namespace, user string) *testClient {
+	t.Helper()
+	c := newTestConn(t, ns)
+	if err := c.attach(0, nofid, user); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestConn serves the namespace over a pipe and negotiates the
+// protocol version.
+func newTestConn(t testing.TB, ns *Namespace) *testClient {
+	t.Helper()
+	srv, cli := net.Pipe()
+	go ns.ServeConn(srv)
+	c := &testClient{t: t, conn: cli}
+	if err := c.version(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// send a request without waiting for the response; returns the tag used.
+func (c *testClient) send(typ byte, body msgBuf) uint16 {
+	c.t.Helper()
+	tag := c.tag
+	c.tag++
+	if c.tag == 0xffff {
+		c.tag = 0
+	}
+	hdr := make(msgBuf, 0, 7+len(body))
+	hdr = hdr.u32(uint32(7 + len(body)))
+	hdr = append(hdr, typ)
+	hdr = hdr.u16(tag)
+	if _, err := c.conn.Write(append(hdr, body...)); err != nil {
+		c.t.Fatal(err)
+	}
+	return tag
+}
+
+// recv the next response from the server (typ is 0 if the connection
+// failed).
+func (c *testClient) recv() (typ byte, tag uint16, body []byte, err error) {
+	c.t.Helper()
+	var hdr [7]byte
+	if _, err = io.ReadFull(c.conn, hdr[:]); err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	typ = hdr[4]
+	tag = binary.LittleEndian.Uint16(hdr[5:])
+	body = make([]byte, size-7)
+	if _, err = io.ReadFull(c.conn, body); err != nil {
+		return
+	}
+	if typ == msgRerror {
+		n := binary.LittleEndian.Uint16(body)
+		err = errors.New(string(body[2 : 2+n]))
+	}
+	return
+}
+
+// rpc sends a request and waits for its response.
+func (c *testClient) rpc(typ byte, body msgBuf) (rtyp byte, rbody []byte, err error) {
+	c.t.Helper()
+	tag := c.send(typ, body)
+	var rtag uint16
+	if rtyp, rtag, rbody, err = c.recv(); rtyp != 0 && rtag != tag {
+		c.t.Fatalf("tag mismatch: %d != %d", rtag, tag)
+	}
+	return
+}
+
+// version negotiates the protocol version (NOTAG).
+func (c *testClient) version() (err error) {
+	var b msgBuf
+	c.tag = 0xffff
+	_, _, err = c.rpc(msgTversion, b.u32(8192+ioHdrSize).str("9P2000"))
+	return
+}
+
+func (c *testClient) auth(afid uint32, user string) (qid ninep.Qid, err error) {
+	var b msgBuf
+	var r []byte
+	if _, r, err = c.rpc(msgTauth, b.u32(afid).str(user).str("")); err != nil {
+		return
+	}
+	return decodeQid(r), nil
+}
+
+func (c *testClient) attach(fid, afid uint32, user string) (err error) {
+	var b msgBuf
+	_, _, err = c.rpc(msgTattach, b.u32(fid).u32(afid).str(user).str(""))
+	return
+}
+
+func (c *testClient) walk(fid, newfid uint32, names ...string) (qids []ninep.Qid, err error) {
+	var b msgBuf
+	b = b.u32(fid).u32(newfid).u16(uint16(len(names)))
+	for _, n := range names {
+		b = b.str(n)
+	}
+	var r []byte
+	if _, r, err = c.rpc(msgTwalk, b); err != nil {
+		return
+	}
+	num := int(binary.LittleEndian.Uint16(r))
+	for i := range num {
+		qids = append(qids, decodeQid(r[2+13*i:]))
+	}
+	if len(names) > 0 && num != len(names) {
+		err = errNoFile
+	}
+	return
+}
+
+func (c *testClient) open(fid uint32, mode byte) (qid ninep.Qid, iounit uint32, err error) {
+	var b msgBuf
+	var r []byte
+	if _, r, err = c.rpc(msgTopen, b.u32(fid).u8(mode)); err != nil {
+		return
+	}
+	return decodeQid(r), binary.LittleEndian.Uint32(r[13:]), nil
+}
+
+func (c *testClient) create(fid uint32, name string, perm uint32, mode byte) (qid ninep.Qid, err error) {
+	var b msgBuf
+	var r []byte
+	if _, r, err = c.rpc(msgTcreate, b.u32(fid).str(name).u32(perm).u8(mode)); err != nil {
+		return
+	}
+	return decodeQid(r), nil
+}
+
+func (c *testClient) read(fid uint32, off uint64, count uint32) (data []byte, err error) {
+	var b msgBuf
+	var r []byte
+	if _, r, err = c.rpc(msgTread, b.u32(fid).u64(off).u32(count)); err != nil {
+		return
+	}
+	n := binary.LittleEndian.Uint32(r)
+	return r[4 : 4+n], nil
+}
+
+// readAll reads a file sequentially in chunks of given size.
+func (c *testClient) readAll(fid uint32, chunk uint32) (data []byte, err error) {
+	for {
+		var buf []byte
+		if buf, err = c.read(fid, uint64(len(data)), chunk); err != nil || len(buf) == 0 {
+			return
+		}
+		data = append(data, buf...)
+	}
+}
+
+func (c *testClient) write(fid uint32, off uint64, data []byte) (n uint32, err error) {
+	var b msgBuf
+	b = b.u32(fid).u64(off).u32(uint32(len(data)))
+	var r []byte
+	if _, r, err = c.rpc(msgTwrite, append(b, data...)); err != nil {
+		return
+	}
+	return binary.LittleEndian.Uint32(r), nil
+}
+
+func (c *testClient) clunk(fid uint32) (err error) {
+	var b msgBuf
+	_, _, err = c.rpc(msgTclunk, b.u32(fid))
+	return
+}
+
+func (c *testClient) wstat(fid uint32, d *ninep.Dir) (err error) {
+	var b msgBuf
+	stat := encodeDir(d)
+	b = b.u32(fid).u16(uint16(len(stat)))
+	_, _, err = c.rpc(msgTwstat, append(b, stat...))
+	return
+}
+
+func (c *testClient) remove(fid uint32) (err error) {
+	var b msgBuf
+	_, _, err = c.rpc(msgTremove, b.u32(fid))
+	return
+}
+
+func (c *testClient) stat(fid uint32) (d *ninep.Dir, err error) {
+	var b msgBuf
+	var r []byte
+	if _, r, err = c.rpc(msgTstat, b.u32(fid)); err != nil {
+		return
+	}
+	d, _, err = decodeDir(r[2:])
+	return
+}
+
+// list reads a directory and returns the names of its entries.
+func (c *testClient) list(fid uint32, chunk uint32) (names []string, err error) {
+	var off uint64
+	for {
+		var buf []byte
+		if buf, err = c.read(fid, off, chunk); err != nil || len(buf) == 0 {
+			return
+		}
+		off += uint64(len(buf))
+		for len(buf) > 0 {
+			var d *ninep.Dir
+			if d, buf, err = decodeDir(buf); err != nil {
+				return
+			}
+			names = append(names, d.Name)
+		}
+	}
+}
+
+//----------------------------------------------------------------------
+// message encoding helpers
+//----------------------------------------------------------------------
+
+type msgBuf []byte
+
+func (b msgBuf) u8(v byte) msgBuf { return append(b, v) }
+func (b msgBuf) u16(v uint16) msgBuf {
+	return binary.LittleEndian.AppendUint16(b, v)
+}
+func (b msgBuf) u32(v uint32) msgBuf {
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+func (b msgBuf) u64(v uint64) msgBuf {
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+func (b msgBuf) str(s string) msgBuf {
+	return append(b.u16(uint16(len(s))), s...)
+}
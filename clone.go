@@ -0,0 +1,243 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"strconv"
+	"sync"
+)
+
+// CloneFunc creates the content of a new resource directory with given
+// number (like the "ctl", "data" and "status" files of a connection in
+// /net/tcp). The returned function (if not nil) is called when the
+// directory is removed after the last fid using it has been clunked.
+type CloneFunc func(n int) (items []DirItem, done func(), err error)
+
+// NewCloneDir creates a directory with a "clone" file that allocates
+// resource directories (like /net/tcp/clone on Plan 9): opening the clone
+// file creates a new numbered directory with content generated by fcn.
+// Reading the opened clone file returns the number of the directory;
+// writes are passed to its "ctl" file (if any). Access to the clone file
+// (mode 0666) is controlled by the permissions of the directory. The
+// resource directories inherit these permissions; a resource directory is
+// removed when the last fid opened on it (or on the clone file that
+// created it) is clunked.
+func (ns *Namespace) NewCloneDir(path string, perm uint32, fcn CloneFunc) error {
+	if len(path) == 0 || path[0] != '/' {
+		return errNoAbs
+	}
+	dir, name := split(path)
+	if !validName(name) {
+		return errName
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	e := ns.newEntry(name, ns.user, ns.group, perm, nil)
+	if err := ns.new(dir, e); err != nil {
+		return err
+	}
+	cd := &cloneDir{
+		dir:   e,
+		fcn:   fcn,
+		convs: make(map[int]*conv),
+	}
+	ns.insert(e, ns.newEntry("clone", ns.user, ns.group, 0666, &cloneFile{cd: cd}))
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// cloneDir allocates the resource directories of a clone directory.
+type cloneDir struct {
+	dir   *Entry        // clone directory
+	fcn   CloneFunc     // content of new resource directories
+	convs map[int]*conv // allocated resource directories
+	mtx   sync.Mutex    // lock for allocations and reference counts
+}
+
+// conv is an allocated resource directory.
+type conv struct {
+	cd   *cloneDir // clone directory
+	n    int       // number of resource directory
+	dir  *Entry    // resource directory
+	ctl  File      // control file (or nil)
+	done func()    // cleanup function (or nil)
+	ref  int       // number of opened fids
+}
+
+// alloc a new resource directory (with the lowest unused number). The
+// new directory is referenced once.
+func (cd *cloneDir) alloc() (*conv, error) {
+	cd.mtx.Lock()
+	n := 0
+	for cd.convs[n] != nil {
+		n++
+	}
+	cv := &conv{cd: cd, n: n, ref: 1}
+	cd.convs[n] = cv
+	cd.mtx.Unlock()
+
+	items, done, err := cd.fcn(n)
+	if err == nil {
+		cv.done = done
+		err = cd.insert(cv, items)
+	}
+	if err != nil {
+		if done != nil {
+			done()
+		}
+		cd.mtx.Lock()
+		delete(cd.convs, n)
+		cd.mtx.Unlock()
+		return nil, err
+	}
+	return cv, nil
+}
+
+// insert the directory of an allocated resource into the clone directory.
+func (cd *cloneDir) insert(cv *conv, items []DirItem) error {
+	ns := cd.dir.ns
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if ns.dict[cd.dir.ref.Path] != cd.dir {
+		return errNoFile
+	}
+	name := strconv.Itoa(cv.n)
+	if _, ok := cd.dir.children[name]; ok {
+		return errExists
+	}
+	uid, gid := cd.dir.ref.Uid, cd.dir.ref.Gid
+	d := ns.newEntry(name, uid, gid, cd.dir.ref.Mode, nil)
+	d.clone = cv
+	for _, item := range items {
+		if _, ok := d.children[item.Name]; ok || !validName(item.Name) {
+			continue
+		}
+		c := ns.newEntry(item.Name, uid, gid, item.Perm, item.File)
+		c.list = item.Dir
+		if item.Name == "ctl" && item.File != nil {
+			cv.ctl = item.File
+		}
+		ns.insert(d, c)
+	}
+	ns.insert(cd.dir, d)
+	cv.dir = d
+	return nil
+}
+
+// acquire a reference to a resource directory. Returns false if the
+// directory has already been released.
+func (cv *conv) acquire() bool {
+	cv.cd.mtx.Lock()
+	defer cv.cd.mtx.Unlock()
+	if cv.ref == 0 {
+		return false
+	}
+	cv.ref++
+	return true
+}
+
+// release a reference to a resource directory: the directory is removed
+// after the last reference is released. The number of the directory is
+// only reused after it has been removed.
+func (cv *conv) release() {
+	cd := cv.cd
+	cd.mtx.Lock()
+	cv.ref--
+	last := cv.ref == 0
+	cd.mtx.Unlock()
+	if !last {
+		return
+	}
+	ns := cd.dir.ns
+	ns.mtx.Lock()
+	ns.remove(cv.dir, true)
+	ns.mtx.Unlock()
+
+	cd.mtx.Lock()
+	delete(cd.convs, cv.n)
+	cd.mtx.Unlock()
+	if cv.done != nil {
+		cv.done()
+	}
+}
+
+// resource returns the resource directory an entry belongs to (or nil).
+func (ns *Namespace) resource(e *Entry) *conv {
+	ns.mtx.RLock()
+	defer ns.mtx.RUnlock()
+	for ; e != nil; e = e.parent {
+		if e.clone != nil {
+			return e.clone
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------
+
+// cloneFile allocates a new resource directory whenever it is opened.
+type cloneFile struct {
+	NopFile
+	cd *cloneDir
+}
+
+// Handle implementation: allocate a resource directory for an opened fid.
+func (f *cloneFile) Handle() (File, error) {
+	cv, err := f.cd.alloc()
+	if err != nil {
+		return nil, err
+	}
+	return &cloneHandle{cv: cv}, nil
+}
+
+// cloneHandle is an opened clone file referencing its resource directory.
+type cloneHandle struct {
+	cv *conv
+}
+
+// Read implementation: return the number of the resource directory.
+func (h *cloneHandle) Read() ([]byte, error) {
+	return []byte(strconv.Itoa(h.cv.n)), nil
+}
+
+// Write implementation: pass data to the control file.
+func (h *cloneHandle) Write(data []byte) error {
+	if h.cv.ctl == nil {
+		return errPerm
+	}
+	return h.cv.ctl.Write(data)
+}
+
+// WriteAt implementation: control messages are written independent of
+// the offset.
+func (h *cloneHandle) WriteAt(p []byte, off int64) (int, error) {
+	if err := h.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implementation: release the resource directory.
+func (h *cloneHandle) Close() error {
+	h.cv.release()
+	return nil
+}
@@ -0,0 +1,137 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestCloneDir(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// measurement sessions
+	var mtx sync.Mutex
+	ctls := make(map[int]*MemFile)
+	done := 0
+	meas := func(n int) ([]DirItem, func(), error) {
+		ctl := NewMemFile(nil)
+		mtx.Lock()
+		ctls[n] = ctl
+		mtx.Unlock()
+		items := []DirItem{
+			{Name: "ctl", Perm: 0666, File: ctl},
+			{Name: "data", Perm: 0444, File: NewTextFile(fmt.Sprintf("samples %d", n))},
+			{Name: "status", Perm: 0444, File: NewTextFile("idle")},
+		}
+		return items, func() {
+			mtx.Lock()
+			done++
+			mtx.Unlock()
+		}, nil
+	}
+	if err = ns.NewCloneDir("/meas", 0555, meas); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+
+	// clone opens a fid and returns the number of the new directory
+	clone := func(fid uint32) string {
+		t.Helper()
+		if _, err := c.walk(0, fid, "meas", "clone"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.open(fid, ORDWR); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := c.read(fid, 0, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	list := func() []string {
+		t.Helper()
+		if _, err := c.walk(0, 9, "meas"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.open(9, OREAD); err != nil {
+			t.Fatal(err)
+		}
+		names, err := c.list(9, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.clunk(9); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	if n := clone(1); n != "0" {
+		t.Fatalf("clone: %q", n)
+	}
+	if n := clone(2); n != "1" {
+		t.Fatalf("clone: %q", n)
+	}
+	if names := list(); !slices.Equal(names, []string{"0", "1", "clone"}) {
+		t.Fatalf("listing: %v", names)
+	}
+	// writes to the clone fid go to the control file
+	if _, err = c.write(1, 0, []byte("start 100")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ctls[0].Read(); string(data) != "start 100" {
+		t.Fatalf("ctl: %q", data)
+	}
+	// opened files keep the directory alive
+	if _, err = c.walk(0, 3, "meas", "0", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(3, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.clunk(1); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := c.read(3, 0, 64); err != nil || string(buf) != "samples 0" {
+		t.Fatalf("data: %q, %v", buf, err)
+	}
+	if err = c.clunk(3); err != nil {
+		t.Fatal(err)
+	}
+	if names := list(); !slices.Equal(names, []string{"1", "clone"}) {
+		t.Fatalf("listing: %v", names)
+	}
+	if _, err = ns.Get("/meas/0"); err == nil {
+		t.Fatal("released directory still present")
+	}
+	if done != 1 {
+		t.Fatalf("cleanup called %d times", done)
+	}
+	// numbers are reused
+	if n := clone(1); n != "0" {
+		t.Fatalf("clone: %q", n)
+	}
+}
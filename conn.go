@@ -0,0 +1,550 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// 9p message types
+const (
+	msgTversion = 100 + 2*iota
+	msgTauth
+	msgTattach
+	msgTerror
+	msgTflush
+	msgTwalk
+	msgTopen
+	msgTcreate
+	msgTread
+	msgTwrite
+	msgTclunk
+	msgTremove
+	msgTstat
+	msgTwstat
+)
+
+// 9p response types used in the message filter
+const (
+	msgRauth  = msgTauth + 1
+	msgRerror = msgTerror + 1
+	msgRread  = msgTread + 1
+	msgRwrite = msgTwrite + 1
+	msgRclunk = msgTclunk + 1
+	msgRstat  = msgTstat + 1
+	msgRwstat = msgTwstat + 1
+)
+
+// size of a 9p message header (size[4] type[1] tag[2])
+const hdrSize = 7
+
+// Error messages
+var (
+	errMsg = errors.New("malformed message")
+)
+
+//----------------------------------------------------------------------
+
+// conn wraps the transport of a 9p connection served by ninep and
+// filters the message stream for requests ninep can't handle itself:
+//
+//   - Twstat: ninep crashes decoding the message. The request is handed
+//     to ninep as Tstat for the same fid (to resolve the fid), with the
+//     requested changes passed to the session out-of-band. The Rstat
+//     response is turned into a Rwstat.
+//
+//   - Tflush: ninep doesn't abort pending requests. Requests answered
+//     asynchronously (see pend) are canceled before ninep gets the Tflush
+//     and responds with Rflush.
+//
+//   - Tauth: ninep rejects authentication. If authentication is required,
+//     auth fids and attach requests are handled by the filter (see
+//     authFilter).
+//
+//   - Tversion: ninep accepts any message size. The requested size is
+//     capped by the limits of the namespace (see SetLimits); read counts
+//     are capped by the negotiated size.
+//
+// ninep exits the process on transport errors: a broken connection ends
+// the reader goroutine instead (see close).
+//
+// ninep reads requests sequentially and calls the session handler for a
+// request before reading the next one: out-of-band data set for a request
+// (and the tag and fid of the request) is valid until the next request
+// is read.
+type conn struct {
+	rw      io.ReadWriter         // transport
+	frame   []byte                // remaining bytes of the current request
+	tag     uint16                // tag of the current request
+	fid     uint32                // fid of the current request
+	id      uint64                // connection identifier
+	remote  string                // remote address (if known)
+	wstat   *ninep.Dir            // requested stat changes (current request)
+	wtags   map[uint16]bool       // tags of Twstat requests in progress
+	pending map[uint16]*request   // asynchronous requests in progress
+	auth    AuthProto             // required authentication (or nil)
+	afids   map[uint32]*authFid   // auth fids (used by the reader only)
+	apath   uint64                // last Qid.Path of an auth fid
+	mem     *budget               // memory accounting
+	msize   uint32                // negotiated message size (or 0)
+	cost    int                   // memory reserved for the connection
+	link    *link                 // activity tracking (see Server) or nil
+	halt    bool                  // blocking reads interrupted
+	ns      *Namespace            // served namespace
+	handles map[uint32]*ninep.Qid // qids of opened fids (closed with the connection)
+	mtx     sync.Mutex            // serialize access to wtags, pending and handles
+	wmtx    sync.Mutex            // serialize writes to the transport
+}
+
+// request answered asynchronously
+type request struct {
+	tag     uint16     // tag of the request
+	cancel  func()     // cancel request processing
+	flushed bool       // request flushed by client
+	done    bool       // response sent
+	mtx     sync.Mutex // serialize response and flush
+}
+
+// newConn wraps a client transport to a namespace.
+func newConn(rw io.ReadWriter, ns *Namespace) *conn {
+	return &conn{
+		rw:      rw,
+		wtags:   make(map[uint16]bool),
+		pending: make(map[uint16]*request),
+		auth:    ns.authProto(),
+		afids:   make(map[uint32]*authFid),
+		id:      connID.Add(1),
+		mem:     &ns.mem,
+		ns:      ns,
+		handles: make(map[uint32]*ninep.Qid),
+	}
+}
+
+// last connection identifier
+var connID atomic.Uint64
+
+// Read the (filtered) request stream.
+func (c *conn) Read(p []byte) (n int, err error) {
+	if len(c.frame) == 0 {
+		c.wstat = nil
+		if c.frame, err = c.next(); err != nil {
+			c.close()
+		}
+		c.tag = binary.LittleEndian.Uint16(c.frame[5:])
+		c.fid = ^uint32(0)
+		if t := c.frame[4]; t != msgTversion && t != msgTflush && len(c.frame) >= hdrSize+4 {
+			c.fid = binary.LittleEndian.Uint32(c.frame[hdrSize:])
+		}
+	}
+	n = copy(p, c.frame)
+	c.frame = c.frame[n:]
+	return
+}
+
+// next reads the next request from the client and filters it.
+func (c *conn) next() (frame []byte, err error) {
+	for {
+		if c.link.draining() {
+			return nil, io.EOF
+		}
+		if frame, err = readFrame(c.rw, c.mem.limit(c.msize)); err != nil {
+			return
+		}
+		if frame, err = c.filter(frame); err != nil {
+			return
+		}
+		if frame != nil {
+			c.link.begin()
+			return
+		}
+	}
+}
+
+// readFrame reads the next message (up to max bytes) from a transport.
+func readFrame(r io.Reader, max uint32) (frame []byte, err error) {
+	var hdr [hdrSize]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size < hdrSize || size > max {
+		return nil, errMsg
+	}
+	frame = make([]byte, size)
+	copy(frame, hdr[:])
+	_, err = io.ReadFull(r, frame[hdrSize:])
+	return
+}
+
+// filter a request: returns the (modified) request for ninep or nil if
+// the request has been handled.
+func (c *conn) filter(frame []byte) ([]byte, error) {
+	tag := binary.LittleEndian.Uint16(frame[5:])
+	if c.auth != nil {
+		if done, err := c.authFilter(frame); done {
+			return nil, err
+		}
+	}
+	switch frame[4] {
+	case msgTversion:
+		// msize[4] version[s]
+		if len(frame) < hdrSize+4 {
+			return nil, c.error(tag, errMsg)
+		}
+		msize, cost, err := c.mem.alloc(binary.LittleEndian.Uint32(frame[hdrSize:]), c.cost)
+		if err != nil {
+			return nil, c.error(tag, err)
+		}
+		c.msize, c.cost = msize, cost
+		binary.LittleEndian.PutUint32(frame[hdrSize:], msize)
+
+	case msgTwalk:
+		// fid[4] newfid[4] nwname[2] nwname*(wname[s]); ninep shares the
+		// Qid (and therefore the handle) of a fid with its clone, so walks
+		// from opened fids (not allowed in 9P) are rejected here.
+		if len(frame) < hdrSize+4 {
+			return nil, c.error(tag, errMsg)
+		}
+		if c.opened(binary.LittleEndian.Uint32(frame[hdrSize:])) {
+			return nil, c.error(tag, errOpen)
+		}
+
+	case msgTread:
+		// fid[4] offset[8] count[4]
+		if len(frame) < hdrSize+16 {
+			return nil, c.error(tag, errMsg)
+		}
+		if n := c.iounit(); binary.LittleEndian.Uint32(frame[hdrSize+12:]) > n {
+			binary.LittleEndian.PutUint32(frame[hdrSize+12:], n)
+		}
+
+	case msgTwstat:
+		// fid[4] n[2] stat[n]
+		var err error
+		if len(frame) < hdrSize+6 {
+			err = errMsg
+		} else {
+			c.wstat, _, err = decodeDir(frame[hdrSize+6:])
+		}
+		if err != nil {
+			return nil, c.error(tag, err)
+		}
+		c.mtx.Lock()
+		c.wtags[tag] = true
+		c.mtx.Unlock()
+		frame = frame[:hdrSize+4]
+		binary.LittleEndian.PutUint32(frame, uint32(len(frame)))
+		frame[4] = msgTstat
+
+	case msgTflush:
+		// oldtag[2]
+		if len(frame) < hdrSize+2 {
+			return nil, c.error(tag, errMsg)
+		}
+		c.flush(binary.LittleEndian.Uint16(frame[hdrSize:]))
+	}
+	return frame, nil
+}
+
+// iounit returns the largest data size of a read or write. Without a
+// negotiated message size only small requests are served.
+func (c *conn) iounit() uint32 {
+	return max(c.msize, minMsize) - ioHdrSize
+}
+
+// close a broken connection: the transport is closed, asynchronous
+// requests are canceled, opened fids are closed (as if clunked, but
+// ORCLOSE files are kept), the memory reservation is released and the
+// calling ninep reader exits (ending the ninep writer).
+func (c *conn) close() {
+	closeTransport(c.rw)
+	c.mtx.Lock()
+	tags := make([]uint16, 0, len(c.pending))
+	for tag := range c.pending {
+		tags = append(tags, tag)
+	}
+	c.mtx.Unlock()
+	for _, tag := range tags {
+		c.flush(tag)
+	}
+	c.mtx.Lock()
+	qids := c.handles
+	c.handles = make(map[uint32]*ninep.Qid)
+	c.mtx.Unlock()
+	for _, q := range qids {
+		if h := c.ns.release(q); h != nil {
+			h.close()
+		}
+	}
+	c.mem.release(c.cost)
+	runtime.Goexit()
+}
+
+// track the handle of the opened fid of the current request (identified
+// by the Qid of the fid); a nil Qid untracks the fid.
+func (c *conn) track(q *ninep.Qid) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if q != nil {
+		c.handles[c.fid] = q
+	} else {
+		delete(c.handles, c.fid)
+	}
+}
+
+// opened returns true if a fid is open.
+func (c *conn) opened(fid uint32) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, ok := c.handles[fid]
+	return ok
+}
+
+// closeTransport closes a client transport (if possible).
+func closeTransport(rw io.ReadWriter) {
+	if cl, ok := rw.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// pend registers the current request as answered asynchronously; cancel
+// is called if the client flushes the request. The response must be sent
+// with respond.
+func (c *conn) pend(cancel func()) *request {
+	req := &request{tag: c.tag, cancel: cancel}
+	c.mtx.Lock()
+	c.pending[req.tag] = req
+	halt := c.halt
+	c.mtx.Unlock()
+	if halt {
+		cancel()
+	}
+	return req
+}
+
+// respond to an asynchronous request (unless it has been flushed).
+func (c *conn) respond(req *request, fcn func()) {
+	req.mtx.Lock()
+	if !req.flushed {
+		fcn()
+		req.done = true
+	}
+	req.mtx.Unlock()
+
+	c.mtx.Lock()
+	if c.pending[req.tag] == req {
+		delete(c.pending, req.tag)
+	}
+	c.mtx.Unlock()
+}
+
+// flush an asynchronous request: a response already handed to ninep is
+// sent before the Rflush; otherwise the request is canceled without
+// a response.
+func (c *conn) flush(tag uint16) {
+	c.mtx.Lock()
+	req, ok := c.pending[tag]
+	delete(c.pending, tag)
+	c.mtx.Unlock()
+	if ok {
+		req.mtx.Lock()
+		answered := req.done
+		req.flushed = true
+		req.mtx.Unlock()
+		req.cancel()
+		if !answered {
+			c.link.end()
+		}
+	}
+}
+
+// interrupt all blocking reads (now and later): the reads are answered
+// with an error.
+func (c *conn) interrupt() {
+	c.mtx.Lock()
+	c.halt = true
+	reqs := make([]*request, 0, len(c.pending))
+	for _, req := range c.pending {
+		reqs = append(reqs, req)
+	}
+	c.mtx.Unlock()
+	for _, req := range reqs {
+		req.cancel()
+	}
+}
+
+// error responds to a request with an error message.
+func (c *conn) error(tag uint16, err error) error {
+	msg := err.Error()
+	p := binary.LittleEndian.AppendUint16(nil, uint16(len(msg)))
+	return c.reply(msgRerror, tag, append(p, msg...))
+}
+
+// reply to a request with a response of given type and body.
+func (c *conn) reply(typ byte, tag uint16, body []byte) error {
+	p := make([]byte, hdrSize, hdrSize+len(body))
+	binary.LittleEndian.PutUint32(p, uint32(cap(p)))
+	p[4] = typ
+	binary.LittleEndian.PutUint16(p[5:], tag)
+	c.send(append(p, body...))
+	return nil
+}
+
+// Write a response (from ninep) to the client.
+func (c *conn) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if n < hdrSize {
+		return 0, errMsg
+	}
+	tag := binary.LittleEndian.Uint16(p[5:])
+	c.mtx.Lock()
+	if c.wtags[tag] {
+		delete(c.wtags, tag)
+		if p[4] == msgRstat {
+			p = make([]byte, hdrSize)
+			binary.LittleEndian.PutUint32(p, hdrSize)
+			p[4] = msgRwstat
+			binary.LittleEndian.PutUint16(p[5:], tag)
+		}
+	}
+	c.mtx.Unlock()
+	c.send(p)
+	c.link.end()
+	return
+}
+
+// send a message to the client. Transport errors are handled by the
+// reader (ninep exits the process on write errors).
+func (c *conn) send(p []byte) {
+	c.wmtx.Lock()
+	c.rw.Write(p)
+	c.wmtx.Unlock()
+}
+
+//----------------------------------------------------------------------
+
+// decodeQid decodes a Qid.
+func decodeQid(b []byte) ninep.Qid {
+	return ninep.Qid{
+		Type: b[0],
+		Vers: binary.LittleEndian.Uint32(b[1:]),
+		Path: binary.LittleEndian.Uint64(b[5:]),
+	}
+}
+
+// dirSize returns the size of an encoded stat entry.
+func dirSize(d *ninep.Dir) uint64 {
+	return uint64(49 + len(d.Name) + len(d.Uid) + len(d.Gid) + len(d.Muid))
+}
+
+// encodeDir encodes a stat entry.
+func encodeDir(d *ninep.Dir) []byte {
+	b := make([]byte, 2, 2+dirSize(d))
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = appendQid(b, d.Qid)
+	b = binary.LittleEndian.AppendUint32(b, d.Mode)
+	b = binary.LittleEndian.AppendUint32(b, d.Atime)
+	b = binary.LittleEndian.AppendUint32(b, d.Mtime)
+	b = binary.LittleEndian.AppendUint64(b, d.Len)
+	for _, s := range []string{d.Name, d.Uid, d.Gid, d.Muid} {
+		b = appendStr(b, s)
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(b)-2))
+	return b
+}
+
+// appendQid appends an encoded Qid to a buffer.
+func appendQid(b []byte, q ninep.Qid) []byte {
+	b = append(b, q.Type)
+	b = binary.LittleEndian.AppendUint32(b, q.Vers)
+	return binary.LittleEndian.AppendUint64(b, q.Path)
+}
+
+// appendStr appends an encoded string to a buffer.
+func appendStr(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// dontTouch returns a stat entry that leaves all fields unchanged
+// when used in a Twstat request.
+func dontTouch() *ninep.Dir {
+	return &ninep.Dir{
+		Qid: ninep.Qid{
+			Type: 0xff,
+			Vers: 0xffffffff,
+			Path: 0xffffffffffffffff,
+		},
+		Mode:  0xffffffff,
+		Atime: 0xffffffff,
+		Mtime: 0xffffffff,
+		Len:   0xffffffffffffffff,
+	}
+}
+
+// decodeDir decodes a stat entry and returns the remaining buffer.
+func decodeDir(b []byte) (d *ninep.Dir, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errMsg
+	}
+	size := int(binary.LittleEndian.Uint16(b)) + 2
+	if size < 49 || size > len(b) {
+		return nil, nil, errMsg
+	}
+	d = &ninep.Dir{
+		Qid:   decodeQid(b[8:]),
+		Mode:  binary.LittleEndian.Uint32(b[21:]),
+		Atime: binary.LittleEndian.Uint32(b[25:]),
+		Mtime: binary.LittleEndian.Uint32(b[29:]),
+		Len:   binary.LittleEndian.Uint64(b[33:]),
+	}
+	s := b[41:size]
+	str := func() string {
+		if err != nil || len(s) < 2 {
+			err = errMsg
+			return ""
+		}
+		n := int(binary.LittleEndian.Uint16(s)) + 2
+		if n > len(s) {
+			err = errMsg
+			return ""
+		}
+		v := string(s[2:n])
+		s = s[n:]
+		return v
+	}
+	d.Name = str()
+	d.Uid = str()
+	d.Gid = str()
+	d.Muid = str()
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, b[size:], nil
+}
@@ -0,0 +1,582 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// Protocol dialects
+const (
+	dialectL = "9P2000.L" // Linux v9fs
+	dialectU = "9P2000.u" // Unix extensions
+)
+
+// Numeric ids
+const (
+	noUID  = ^uint32(0) // no numeric user id (Tattach)
+	nobody = 65534      // numeric id of unknown users and groups
+)
+
+// block size reported to clients (and used for directory reads)
+const blockSize = 8192
+
+// Linux error numbers
+const (
+	eNOENT     = 2
+	eINTR      = 4
+	eIO        = 5
+	eBADF      = 9
+	eACCES     = 13
+	eBUSY      = 16
+	eEXIST     = 17
+	eXDEV      = 18
+	eNOTDIR    = 20
+	eISDIR     = 21
+	eINVAL     = 22
+	eFBIG      = 27
+	eNOTEMPTY  = 39
+	eOPNOTSUPP = 95
+)
+
+// Error messages
+var (
+	errFlushed = errors.New("request flushed")
+	errXDev    = errors.New("cross-directory rename")
+	errNotSupp = errors.New("operation not supported")
+)
+
+// errnos maps error messages to Linux error numbers.
+var errnos = map[string]uint32{
+	errNoRoot.Error():   eNOENT,
+	errNoFile.Error():   eNOENT,
+	errNoDir.Error():    eNOTDIR,
+	errIsDir.Error():    eISDIR,
+	errPerm.Error():     eACCES,
+	errOpen.Error():     eBUSY,
+	errExists.Error():   eEXIST,
+	errName.Error():     eINVAL,
+	errEmpty.Error():    eNOTEMPTY,
+	errExcl.Error():     eBUSY,
+	errIntr.Error():     eINTR,
+	errOffset.Error():   eINVAL,
+	errRange.Error():    eINVAL,
+	errNotOpen.Error():  eBADF,
+	errShort.Error():    eINVAL,
+	errMsg.Error():      eINVAL,
+	errAuthReq.Error():  eACCES,
+	errAuthFail.Error(): eACCES,
+	errXDev.Error():     eXDEV,
+	errNotSupp.Error():  eOPNOTSUPP,
+	errGrowth.Error():   eFBIG,
+
+	// errors reported by ninep
+	"invalid fid":                 eBADF,
+	"start fid invalid":           eBADF,
+	"walk: oldfid does not exist": eBADF,
+	"directory entry not found":   eNOENT,
+	"not implemented":             eOPNOTSUPP,
+}
+
+// errno returns the Linux error number for an error.
+func errno(err error) uint32 {
+	if n, ok := errnos[err.Error()]; ok {
+		return n
+	}
+	return eIO
+}
+
+//----------------------------------------------------------------------
+
+// xlate serves a client using a protocol dialect (9P2000.L or 9P2000.u):
+// the requests are translated to classic 9P requests handled by a regular
+// session (see serve) and the responses are translated back. The
+// translator is the transport of the classic connection.
+//
+// Client requests are processed concurrently (up to maxFlight requests;
+// reading further requests waits for a request to finish); operations
+// without a classic equivalent (like Tmkdir) are performed as a sequence
+// of classic requests on temporary fids.
+type xlate struct {
+	ns      *Namespace             // served namespace
+	dialect string                 // protocol dialect of the client
+	rw      io.ReadWriter          // client transport
+	wmtx    sync.Mutex             // serialize writes to the client
+	reqs    chan []byte            // classic requests
+	done    chan struct{}          // closed when the client is gone
+	slots   chan struct{}          // client requests in progress (bounded)
+	msize   uint32                 // negotiated message size (or 0)
+	link    *link                  // activity tracking (see Server) or nil
+	frame   []byte                 // remaining bytes of current classic request
+	mtx     sync.Mutex             // lock for the state below
+	wait    map[uint16]chan []byte // classic requests in progress (by tag)
+	tag     uint16                 // last classic tag used
+	fid     uint32                 // last temporary fid used
+	flight  map[uint16]*xreq       // client requests in progress (by tag)
+	dirs    map[uint32]*listing    // directory listings (by fid)
+	uids    map[string]uint32      // numeric ids of attached users
+}
+
+// xreq is a client request in progress.
+type xreq struct {
+	tag   uint16        // tag of client request
+	itag  uint16        // tag of current classic request
+	abort chan struct{} // closed when the request is flushed
+	done  chan struct{} // closed when the request is finished
+	once  sync.Once
+}
+
+// listing of an opened directory.
+type listing struct {
+	list []ninep.Dir // directory entries
+	next int         // index of next entry to read
+	off  uint64      // offset of next entry to read
+}
+
+// first temporary fid (fids used by Linux are allocated from 0)
+const tmpFid = 0xf0000000
+
+// max. number of client requests processed concurrently on a connection
+const maxFlight = 32
+
+// dialect returns the protocol dialect requested in a version request
+// (or an empty string for classic 9P).
+func dialect(body []byte) string {
+	r := &msgReader{b: body}
+	r.u32()
+	if v := r.str(); r.err == nil && (v == dialectL || v == dialectU) {
+		return v
+	}
+	return ""
+}
+
+// serveDialect serves the namespace to a client using a protocol
+// dialect; first is the version request already read from the client.
+func (ns *Namespace) serveDialect(rw io.ReadWriter, dialect string, first []byte, remote string, l *link) {
+	x := &xlate{
+		ns:      ns,
+		dialect: dialect,
+		rw:      rw,
+		reqs:    make(chan []byte),
+		done:    make(chan struct{}),
+		slots:   make(chan struct{}, maxFlight),
+		wait:    make(map[uint16]chan []byte),
+		fid:     tmpFid,
+		flight:  make(map[uint16]*xreq),
+		dirs:    make(map[uint32]*listing),
+		uids:    make(map[string]uint32),
+		link:    l,
+	}
+	fin := make(chan struct{})
+	go func() {
+		defer close(fin)
+		ns.serve(x, remote, l, false)
+	}()
+	x.run(first)
+	closeTransport(rw)
+	<-fin
+}
+
+// Read the classic request stream (ends when the client is gone).
+func (x *xlate) Read(p []byte) (int, error) {
+	if len(x.frame) == 0 {
+		select {
+		case x.frame = <-x.reqs:
+		case <-x.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, x.frame)
+	x.frame = x.frame[n:]
+	return n, nil
+}
+
+// Write a classic response: hand it to the waiting request.
+func (x *xlate) Write(p []byte) (int, error) {
+	if len(p) < hdrSize {
+		return 0, errMsg
+	}
+	tag := binary.LittleEndian.Uint16(p[5:])
+	x.mtx.Lock()
+	ch, ok := x.wait[tag]
+	delete(x.wait, tag)
+	x.mtx.Unlock()
+	if ok {
+		ch <- bytes.Clone(p)
+	}
+	return len(p), nil
+}
+
+// run reads and dispatches client requests until the client is gone.
+func (x *xlate) run(frame []byte) {
+	defer close(x.done)
+	handle := x.dotu
+	if x.dialect == dialectL {
+		handle = x.dotl
+	}
+	for {
+		typ, tag := frame[4], binary.LittleEndian.Uint16(frame[5:])
+		body := frame[hdrSize:]
+		x.link.begin()
+		switch typ {
+		case msgTversion:
+			x.version(tag, body)
+			x.link.end()
+		case msgTflush:
+			if len(body) < 2 {
+				x.error(tag, errMsg)
+				x.link.end()
+				break
+			}
+			go func() {
+				defer x.link.end()
+				x.flush(tag, binary.LittleEndian.Uint16(body))
+			}()
+		default:
+			req := &xreq{
+				tag:   tag,
+				abort: make(chan struct{}),
+				done:  make(chan struct{}),
+			}
+			x.slots <- struct{}{}
+			x.mtx.Lock()
+			x.flight[tag] = req
+			x.mtx.Unlock()
+			go func() {
+				defer x.link.end()
+				defer func() { <-x.slots }()
+				defer close(req.done)
+				rtyp, rbody, err := handle(req, typ, body)
+				x.mtx.Lock()
+				delete(x.flight, tag)
+				x.mtx.Unlock()
+				switch {
+				case err == errFlushed:
+				case err != nil:
+					x.error(tag, err)
+				default:
+					x.reply(rtyp, tag, rbody)
+				}
+			}()
+		}
+		if x.link.draining() {
+			return
+		}
+		var err error
+		if frame, err = readFrame(x.rw, x.ns.mem.limit(x.msize)); err != nil {
+			return
+		}
+	}
+}
+
+// version negotiates the protocol version with client and session.
+func (x *xlate) version(tag uint16, body []byte) {
+	r := &msgReader{b: body}
+	msize := r.u32()
+	if r.err != nil {
+		x.error(tag, r.err)
+		return
+	}
+	b := binary.LittleEndian.AppendUint32(nil, msize)
+	_, rb, err := x.call(nil, 0xffff, msgTversion, appendStr(b, ninep.Ninep2000))
+	if err == nil && len(rb) < 4 {
+		err = errMsg
+	}
+	if err != nil {
+		x.error(tag, err)
+		return
+	}
+	x.msize = binary.LittleEndian.Uint32(rb)
+	x.reply(msgTversion+1, tag, appendStr(rb[:4], x.dialect))
+}
+
+// flush a client request: the request is answered (or aborted) before
+// the flush is answered.
+func (x *xlate) flush(tag, old uint16) {
+	x.mtx.Lock()
+	req, ok := x.flight[old]
+	x.mtx.Unlock()
+	if ok {
+		x.mtx.Lock()
+		_, active := x.wait[req.itag]
+		x.mtx.Unlock()
+		if active {
+			x.rpc(nil, msgTflush, binary.LittleEndian.AppendUint16(nil, req.itag))
+		}
+		req.once.Do(func() { close(req.abort) })
+		<-req.done
+	}
+	x.reply(msgTflush+1, tag, nil)
+}
+
+// rpc sends a classic request on behalf of a client request (if not nil)
+// and waits for the response. Error responses are returned as errors.
+func (x *xlate) rpc(req *xreq, typ byte, body []byte) (byte, []byte, error) {
+	x.mtx.Lock()
+	for {
+		if x.tag++; x.tag == 0xffff {
+			x.tag = 0
+		}
+		if _, ok := x.wait[x.tag]; !ok {
+			break
+		}
+	}
+	tag := x.tag
+	x.mtx.Unlock()
+	return x.call(req, tag, typ, body)
+}
+
+// call sends a classic request with given tag and waits for the response.
+func (x *xlate) call(req *xreq, tag uint16, typ byte, body []byte) (byte, []byte, error) {
+	var abort chan struct{}
+	if req != nil {
+		abort = req.abort
+		select {
+		case <-abort:
+			return 0, nil, errFlushed
+		default:
+		}
+	}
+	ch := make(chan []byte, 1)
+	x.mtx.Lock()
+	x.wait[tag] = ch
+	if req != nil {
+		req.itag = tag
+	}
+	x.mtx.Unlock()
+
+	frame := make([]byte, hdrSize, hdrSize+len(body))
+	binary.LittleEndian.PutUint32(frame, uint32(cap(frame)))
+	frame[4] = typ
+	binary.LittleEndian.PutUint16(frame[5:], tag)
+	select {
+	case x.reqs <- append(frame, body...):
+	case <-x.done:
+		return 0, nil, errIntr
+	}
+	select {
+	case r := <-ch:
+		if r[4] == msgRerror {
+			msg, _, err := getStr(r[hdrSize:])
+			if err == nil {
+				err = errors.New(msg)
+			}
+			return 0, nil, err
+		}
+		return r[4], r[hdrSize:], nil
+	case <-abort:
+		x.mtx.Lock()
+		delete(x.wait, tag)
+		x.mtx.Unlock()
+		return 0, nil, errFlushed
+	case <-x.done:
+		return 0, nil, errIntr
+	}
+}
+
+// reply to a client request.
+func (x *xlate) reply(typ byte, tag uint16, body []byte) {
+	p := make([]byte, hdrSize, hdrSize+len(body))
+	binary.LittleEndian.PutUint32(p, uint32(cap(p)))
+	p[4] = typ
+	binary.LittleEndian.PutUint16(p[5:], tag)
+	x.wmtx.Lock()
+	x.rw.Write(append(p, body...))
+	x.wmtx.Unlock()
+}
+
+// error responds to a client request with an error number (and message).
+func (x *xlate) error(tag uint16, err error) {
+	if x.dialect == dialectL {
+		x.reply(msgRlerror, tag, binary.LittleEndian.AppendUint32(nil, errno(err)))
+		return
+	}
+	b := appendStr(nil, err.Error())
+	x.reply(msgRerror, tag, binary.LittleEndian.AppendUint32(b, errno(err)))
+}
+
+// tmp returns a new temporary fid.
+func (x *xlate) tmp() uint32 {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if x.fid++; x.fid == ^uint32(0) {
+		x.fid = tmpFid
+	}
+	return x.fid
+}
+
+//----------------------------------------------------------------------
+
+// attach (or authenticate) a client: the numeric id of the user is
+// removed from the request. A number known to the namespace takes
+// precedence over the user name (as in the Linux v9fs client); an unknown
+// number is remembered for the named user on the connection.
+func (x *xlate) attach(req *xreq, typ byte, body []byte) (byte, []byte, error) {
+	// [fid[4]] afid[4] uname[s] aname[s] n_uname[4]
+	r := &msgReader{b: body}
+	r.u32()
+	if typ == msgTattach {
+		r.u32()
+	}
+	head := len(body) - len(r.b)
+	uname := r.str()
+	aname := r.str()
+	uid := r.u32()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if uid != noUID {
+		if name, ok := x.ns.idName(uid); ok {
+			uname = name
+		} else if _, ok := x.ns.id(uname); !ok && len(uname) > 0 {
+			x.mtx.Lock()
+			x.uids[uname] = uid
+			x.mtx.Unlock()
+		}
+	}
+	b := appendStr(appendStr(bytes.Clone(body[:head]), uname), aname)
+	return x.rpc(req, typ, b)
+}
+
+// id returns the numeric id of a user or group.
+func (x *xlate) id(name string) uint32 {
+	if id, ok := x.ns.id(name); ok {
+		return id
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if id, ok := x.uids[name]; ok {
+		return id
+	}
+	return nobody
+}
+
+// name returns the user or group with given numeric id.
+func (x *xlate) name(id uint32) (string, bool) {
+	if name, ok := x.ns.idName(id); ok {
+		return name, true
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	for name, uid := range x.uids {
+		if uid == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// stat of a fid.
+func (x *xlate) stat(req *xreq, fid uint32) (*ninep.Dir, error) {
+	_, b, err := x.rpc(req, msgTstat, binary.LittleEndian.AppendUint32(nil, fid))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 {
+		return nil, errMsg
+	}
+	d, _, err := decodeDir(b[2:])
+	return d, err
+}
+
+// wstat of a fid.
+func (x *xlate) wstat(req *xreq, fid uint32, d *ninep.Dir) error {
+	stat := encodeDir(d)
+	b := binary.LittleEndian.AppendUint32(nil, fid)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(stat)))
+	_, _, err := x.rpc(req, msgTwstat, append(b, stat...))
+	return err
+}
+
+// clunk a temporary fid (even if the request has been flushed).
+func (x *xlate) clunk(fid uint32) {
+	x.rpc(nil, msgTclunk, binary.LittleEndian.AppendUint32(nil, fid))
+}
+
+// forget the directory listing of a fid.
+func (x *xlate) forget(fid uint32) {
+	x.mtx.Lock()
+	delete(x.dirs, fid)
+	x.mtx.Unlock()
+}
+
+// list reads the entries of an opened directory.
+func (x *xlate) list(req *xreq, fid uint32) ([]ninep.Dir, error) {
+	var list []ninep.Dir
+	var pos uint64
+	for {
+		b := binary.LittleEndian.AppendUint32(nil, fid)
+		b = binary.LittleEndian.AppendUint64(b, pos)
+		_, rb, err := x.rpc(req, msgTread, binary.LittleEndian.AppendUint32(b, blockSize))
+		if err != nil {
+			return nil, err
+		}
+		if len(rb) < 4 {
+			return nil, errMsg
+		}
+		data := rb[4:]
+		if len(data) == 0 {
+			return list, nil
+		}
+		pos += uint64(len(data))
+		for len(data) > 0 {
+			var d *ninep.Dir
+			if d, data, err = decodeDir(data); err != nil {
+				return nil, err
+			}
+			list = append(list, *d)
+		}
+	}
+}
+
+//----------------------------------------------------------------------
+
+// msgReader decodes the fields of a message; decoding errors are sticky.
+type msgReader struct {
+	b   []byte
+	err error
+}
+
+// next returns the next n bytes of the message.
+func (r *msgReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errMsg
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *msgReader) u8() byte    { return r.next(1)[0] }
+func (r *msgReader) u32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *msgReader) u64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+
+func (r *msgReader) str() string {
+	n := binary.LittleEndian.Uint16(r.next(2))
+	return string(r.next(int(n)))
+}
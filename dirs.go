@@ -0,0 +1,136 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"reflect"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// DirItem describes an entry in a dynamic directory: a file (if File is
+// set) or a directory (listed by Dir if set, otherwise empty).
+type DirItem struct {
+	Name string  // name of the entry
+	Perm uint32  // permissions
+	File File    // file implementation (for files)
+	Dir  DirFunc // listing function (for directories)
+}
+
+// DirFunc returns the current content of a dynamic directory. It is called
+// whenever a client walks through the directory, lists it or stats one of
+// its entries. Entries keep their Qid path as long as they are listed with
+// the same name, kind and (comparable) file implementation.
+type DirFunc func() ([]DirItem, error)
+
+// NewDynDir creates a directory with content generated by a function.
+// The directory and its content belong to the namespace owner; clients
+// can't create or remove entries in it.
+func (ns *Namespace) NewDynDir(path string, perm uint32, fcn DirFunc) error {
+	if len(path) == 0 || path[0] != '/' {
+		return errNoAbs
+	}
+	dir, name := split(path)
+	if !validName(name) {
+		return errName
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	e := ns.newEntry(name, ns.user, ns.group, perm, nil)
+	e.list = fcn
+	return ns.new(dir, e)
+}
+
+// refresh the content of a dynamic directory (other entries are ignored).
+// The listing function is called without the namespace being locked.
+func (e *Entry) refresh() error {
+	if e == nil {
+		return nil
+	}
+	ns := e.ns
+	ns.mtx.RLock()
+	fcn := e.list
+	ns.mtx.RUnlock()
+	if fcn == nil {
+		return nil
+	}
+	items, err := fcn()
+	if err != nil {
+		return err
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if ns.dict[e.ref.Path] != e {
+		return errNoFile
+	}
+	changed := false
+	keep := make(map[string]bool, len(items))
+	for _, item := range items {
+		if !validName(item.Name) || keep[item.Name] {
+			continue
+		}
+		keep[item.Name] = true
+		perm := item.Perm
+		if item.File == nil {
+			perm |= ninep.DMDir
+		}
+		c, ok := e.children[item.Name]
+		if ok && c.IsDir() == (item.File == nil) && sameFile(c.file, item.File) {
+			// known entry: update permissions and listing function
+			c.ref.Mode = perm
+			c.ref.Type = qidType(perm)
+			c.list = item.Dir
+			continue
+		}
+		n := ns.newEntry(item.Name, e.ref.Uid, e.ref.Gid, perm, item.File)
+		n.list = item.Dir
+		if ok {
+			// replaced entry: keep Qid path
+			ns.drop(c)
+			n.ref.Path = c.ref.Path
+			n.ref.Vers = c.ref.Vers + 1
+		}
+		n.parent = e
+		e.children[n.ref.Name] = n
+		ns.dict[n.ref.Path] = n
+		changed = true
+	}
+	for name, c := range e.children {
+		if !keep[name] {
+			delete(e.children, name)
+			ns.drop(c)
+			changed = true
+		}
+	}
+	if changed {
+		e.modified("")
+	}
+	return nil
+}
+
+// sameFile returns true if both file implementations are identical.
+func sameFile(a, b File) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
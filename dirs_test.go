@@ -0,0 +1,151 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestDynDir(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// simulated bus scan
+	devs := map[int]File{
+		0x20: NewTextFile("expander"),
+		0x48: NewTextFile("adc"),
+	}
+	scan := func() ([]DirItem, error) {
+		var list []DirItem
+		for addr, f := range devs {
+			list = append(list, DirItem{
+				Name: fmt.Sprintf("0x%02x", addr),
+				Perm: 0444,
+				File: f,
+			})
+		}
+		list = append(list, DirItem{
+			Name: "bus",
+			Perm: 0555,
+			Dir: func() ([]DirItem, error) {
+				return []DirItem{{Name: "speed", Perm: 0444, File: NewTextFile("400k")}}, nil
+			},
+		})
+		return list, nil
+	}
+	if err = ns.NewDynDir("/i2c", 0775, scan); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/i2c/0x10", 0444, &NopFile{}); err == nil {
+		t.Fatal("file added to dynamic directory")
+	}
+	if _, err = ns.Get("/i2c/bus/speed"); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+
+	// listing
+	list := func() []string {
+		t.Helper()
+		if _, err := c.walk(0, 1, "i2c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.open(1, OREAD); err != nil {
+			t.Fatal(err)
+		}
+		names, err := c.list(1, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.clunk(1); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(names)
+		return names
+	}
+	if names := list(); !slices.Equal(names, []string{"0x20", "0x48", "bus"}) {
+		t.Fatalf("listing: %v", names)
+	}
+	// stable Qid paths
+	q1, err := c.walk(0, 2, "i2c", "0x20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs[0x21] = NewTextFile("rtc")
+	q2, err := c.walk(0, 3, "i2c", "0x20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q1[1] != q2[1] {
+		t.Fatalf("qid changed: %v != %v", q1[1], q2[1])
+	}
+	if names := list(); !slices.Equal(names, []string{"0x20", "0x21", "0x48", "bus"}) {
+		t.Fatalf("listing: %v", names)
+	}
+	// replaced implementation keeps path, but changes version
+	devs[0x20] = NewTextFile("expander v2")
+	d, err := c.stat(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != q1[1].Path || d.Vers == q1[1].Vers {
+		t.Fatalf("replaced entry: %+v", d)
+	}
+	// vanished entry
+	delete(devs, 0x20)
+	if _, err = c.stat(3); err == nil {
+		t.Fatal("stat on vanished entry")
+	}
+	if _, err = c.walk(0, 4, "i2c", "0x20"); err == nil {
+		t.Fatal("walk to vanished entry")
+	}
+	// generated subdirectory
+	if _, err = c.walk(0, 4, "i2c", "bus", "speed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(4, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.read(4, 0, 64); err != nil || string(data) != "400k" {
+		t.Fatalf("read: %q, %v", data, err)
+	}
+	// no client changes
+	ns.SetGroups(func(user, group string) bool { return true })
+	i2c, _ := ns.Get("/i2c")
+	i2c.SetCreator(func(name string, perm uint32) (File, error) {
+		return NewMemFile(nil), nil
+	})
+	if _, err = c.walk(0, 5, "i2c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.create(5, "new", 0666, OWRITE); err == nil {
+		t.Fatal("created entry in dynamic directory")
+	}
+	if _, err = c.walk(0, 6, "i2c", "0x21"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.remove(6); err == nil {
+		t.Fatal("removed entry from dynamic directory")
+	}
+}
@@ -0,0 +1,396 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"encoding/binary"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// 9P2000.L message types
+const (
+	msgRlerror      = 7
+	msgTstatfs      = 8
+	msgTlopen       = 12
+	msgTlcreate     = 14
+	msgTsymlink     = 16
+	msgTmknod       = 18
+	msgTrename      = 20
+	msgTreadlink    = 22
+	msgTgetattr     = 24
+	msgTsetattr     = 26
+	msgTxattrwalk   = 30
+	msgTxattrcreate = 32
+	msgTreaddir     = 40
+	msgTfsync       = 50
+	msgTlock        = 52
+	msgTgetlock     = 54
+	msgTlink        = 70
+	msgTmkdir       = 72
+	msgTrenameat    = 74
+	msgTunlinkat    = 76
+)
+
+// 9P2000.L protocol values
+const (
+	lOTRUNC     = 0o1000     // open flag: truncate file
+	lSetMode    = 0x00000001 // setattr: change mode
+	lSetUID     = 0x00000002 // setattr: change owner
+	lSetGID     = 0x00000004 // setattr: change group
+	lSetSize    = 0x00000008 // setattr: change size
+	lSetMtime   = 0x00000020 // setattr: change mtime (to now)
+	lSetMtimeTo = 0x00000100 // setattr: change mtime (to given time)
+	lGetBasic   = 0x000007ff // getattr: valid fields
+	lRemoveDir  = 0x200      // unlinkat: remove directory
+	lMagic      = 0x01021997 // statfs: file system type (V9FS_MAGIC)
+	lDirType    = 4          // readdir: directory (DT_DIR)
+	lFileType   = 8          // readdir: regular file (DT_REG)
+	lUnlocked   = 2          // getlock: no lock (F_UNLCK)
+)
+
+//----------------------------------------------------------------------
+
+// dotl handles a 9P2000.L client request (like from the Linux v9fs) and
+// returns the response (type and body).
+func (x *xlate) dotl(req *xreq, typ byte, body []byte) (byte, []byte, error) {
+	r := &msgReader{b: body}
+	fid := r.u32()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	switch typ {
+	case msgTwalk, msgTread, msgTwrite, msgTopen, msgTcreate, msgTstat, msgTwstat:
+		// same in both dialects
+		return x.rpc(req, typ, body)
+
+	case msgTclunk, msgTremove:
+		x.forget(fid)
+		return x.rpc(req, typ, body)
+
+	case msgTauth, msgTattach:
+		return x.attach(req, typ, body)
+
+	case msgTlopen:
+		// fid[4] flags[4]
+		flags := r.u32()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		b := binary.LittleEndian.AppendUint32(nil, fid)
+		_, rb, err := x.rpc(req, msgTopen, append(b, lopenMode(flags)))
+		return msgTlopen + 1, rb, err
+
+	case msgTlcreate:
+		// fid[4] name[s] flags[4] mode[4] gid[4]
+		name, flags, mode := r.str(), r.u32(), r.u32()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		b := binary.LittleEndian.AppendUint32(nil, fid)
+		b = binary.LittleEndian.AppendUint32(appendStr(b, name), mode&0o777)
+		_, rb, err := x.rpc(req, msgTcreate, append(b, lopenMode(flags)))
+		return msgTlcreate + 1, rb, err
+
+	case msgTgetattr:
+		d, err := x.stat(req, fid)
+		if err != nil {
+			return 0, nil, err
+		}
+		return msgTgetattr + 1, x.getattr(d), nil
+
+	case msgTsetattr:
+		return msgTsetattr + 1, nil, x.setattr(req, fid, r)
+
+	case msgTreaddir:
+		// fid[4] offset[8] count[4]
+		off, count := r.u64(), r.u32()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		b, err := x.readdir(req, fid, off, count)
+		return msgTreaddir + 1, b, err
+
+	case msgTmkdir:
+		// dfid[4] name[s] mode[4] gid[4]
+		name, mode := r.str(), r.u32()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		b, err := x.mkdir(req, fid, name, mode)
+		return msgTmkdir + 1, b, err
+
+	case msgTunlinkat:
+		// dfid[4] name[s] flags[4]
+		name, flags := r.str(), r.u32()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		return msgTunlinkat + 1, nil, x.unlink(req, fid, name, flags)
+
+	case msgTrenameat:
+		// olddirfid[4] oldname[s] newdirfid[4] newname[s]
+		oldname, dfid, newname := r.str(), r.u32(), r.str()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		return msgTrenameat + 1, nil, x.rename(req, fid, oldname, dfid, newname)
+
+	case msgTstatfs:
+		b := binary.LittleEndian.AppendUint32(nil, lMagic)
+		b = binary.LittleEndian.AppendUint32(b, blockSize)
+		b = append(b, make([]byte, 6*8)...)
+		return msgTstatfs + 1, binary.LittleEndian.AppendUint32(b, 255), nil
+
+	case msgTfsync:
+		return msgTfsync + 1, nil, nil
+
+	case msgTlock:
+		// fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s]
+		return msgTlock + 1, []byte{0}, nil
+
+	case msgTgetlock:
+		// fid[4] type[1] start[8] length[8] proc_id[4] client_id[s]
+		r.u8()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		return msgTgetlock + 1, append([]byte{lUnlocked}, r.b...), nil
+	}
+	// msgTxattrwalk, msgTxattrcreate, msgTsymlink, msgTmknod, msgTlink,
+	// msgTreadlink, msgTrename and unknown requests
+	return 0, nil, errNotSupp
+}
+
+// lopenMode returns the classic open mode for 9P2000.L open flags.
+func lopenMode(flags uint32) byte {
+	mode := byte(flags & 3)
+	if flags&lOTRUNC != 0 {
+		mode |= OTRUNC
+	}
+	return mode
+}
+
+// getattr encodes the attributes of an entry.
+func (x *xlate) getattr(d *ninep.Dir) []byte {
+	mode := d.Mode & 0o777
+	if d.Mode&ninep.DMDir != 0 {
+		mode |= 0o040000
+	} else {
+		mode |= 0o100000
+	}
+	b := binary.LittleEndian.AppendUint64(nil, lGetBasic)
+	b = appendQid(b, d.Qid)
+	b = binary.LittleEndian.AppendUint32(b, mode)
+	b = binary.LittleEndian.AppendUint32(b, x.id(d.Uid))
+	b = binary.LittleEndian.AppendUint32(b, x.id(d.Gid))
+	for _, v := range []uint64{
+		1,                   // nlink
+		0,                   // rdev
+		d.Len,               // size
+		blockSize,           // blksize
+		(d.Len + 511) / 512, // blocks
+		uint64(d.Atime), 0,  // atime
+		uint64(d.Mtime), 0, // mtime
+		uint64(d.Mtime), 0, // ctime
+		0, 0, // btime
+		0,                  // gen
+		uint64(d.Qid.Vers), // data_version
+	} {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+	return b
+}
+
+// setattr changes the attributes of a fid.
+func (x *xlate) setattr(req *xreq, fid uint32, r *msgReader) error {
+	// valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime_sec[8] mtime_nsec[8]
+	valid, mode, uid, gid, size := r.u32(), r.u32(), r.u32(), r.u32(), r.u64()
+	r.u64()
+	r.u64()
+	mtime := r.u64()
+	if r.err != nil {
+		return r.err
+	}
+	d := dontTouch()
+	changed := false
+	if valid&lSetMode != 0 {
+		cur, err := x.stat(req, fid)
+		if err != nil {
+			return err
+		}
+		d.Mode = cur.Mode&^0o777 | mode&0o777
+		changed = true
+	}
+	for _, id := range []struct {
+		flag uint32
+		id   uint32
+		name *string
+	}{
+		{lSetUID, uid, &d.Uid},
+		{lSetGID, gid, &d.Gid},
+	} {
+		if valid&id.flag == 0 {
+			continue
+		}
+		name, ok := x.name(id.id)
+		if !ok {
+			return errPerm
+		}
+		*id.name = name
+		changed = true
+	}
+	if valid&lSetSize != 0 {
+		d.Len = size
+		changed = true
+	}
+	if valid&lSetMtime != 0 {
+		d.Mtime = now()
+		if valid&lSetMtimeTo != 0 {
+			d.Mtime = uint32(mtime)
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return x.wstat(req, fid, d)
+}
+
+// readdir returns directory entries of an opened directory starting at
+// the given entry (cookie). The listing is read when the directory is read
+// from the start.
+func (x *xlate) readdir(req *xreq, fid uint32, off uint64, count uint32) ([]byte, error) {
+	x.mtx.Lock()
+	dir, ok := x.dirs[fid]
+	x.mtx.Unlock()
+	if off == 0 || !ok {
+		list, err := x.list(req, fid)
+		if err != nil {
+			return nil, err
+		}
+		dir = &listing{list: list}
+		x.mtx.Lock()
+		x.dirs[fid] = dir
+		x.mtx.Unlock()
+	}
+	list := dir.list
+	// entry: qid[13] offset[8] type[1] name[s]
+	b := make([]byte, 4)
+	for i := off; i < uint64(len(list)); i++ {
+		d := &list[i]
+		if len(b)-4+24+len(d.Name) > int(count) {
+			break
+		}
+		b = appendQid(b, d.Qid)
+		b = binary.LittleEndian.AppendUint64(b, i+1)
+		if d.Mode&ninep.DMDir != 0 {
+			b = append(b, lDirType)
+		} else {
+			b = append(b, lFileType)
+		}
+		b = appendStr(b, d.Name)
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+	return b, nil
+}
+
+// mkdir creates a directory and returns its Qid.
+func (x *xlate) mkdir(req *xreq, dfid uint32, name string, mode uint32) ([]byte, error) {
+	tmp := x.tmp()
+	b := binary.LittleEndian.AppendUint32(nil, dfid)
+	b = binary.LittleEndian.AppendUint32(b, tmp)
+	if _, _, err := x.rpc(req, msgTwalk, binary.LittleEndian.AppendUint16(b, 0)); err != nil {
+		return nil, err
+	}
+	defer x.clunk(tmp)
+	b = binary.LittleEndian.AppendUint32(nil, tmp)
+	b = binary.LittleEndian.AppendUint32(appendStr(b, name), ninep.DMDir|mode&0o777)
+	_, rb, err := x.rpc(req, msgTcreate, append(b, OREAD))
+	if err != nil {
+		return nil, err
+	}
+	if len(rb) < 13 {
+		return nil, errMsg
+	}
+	return rb[:13], nil
+}
+
+// walk from a directory fid to an entry with a new temporary fid.
+func (x *xlate) walk(req *xreq, dfid uint32, name string) (uint32, ninep.Qid, error) {
+	tmp := x.tmp()
+	b := binary.LittleEndian.AppendUint32(nil, dfid)
+	b = binary.LittleEndian.AppendUint32(b, tmp)
+	b = appendStr(binary.LittleEndian.AppendUint16(b, 1), name)
+	_, rb, err := x.rpc(req, msgTwalk, b)
+	if err != nil {
+		return 0, ninep.Qid{}, err
+	}
+	if len(rb) < 2+13 {
+		return 0, ninep.Qid{}, errNoFile
+	}
+	return tmp, decodeQid(rb[2:]), nil
+}
+
+// unlink removes an entry from a directory.
+func (x *xlate) unlink(req *xreq, dfid uint32, name string, flags uint32) error {
+	tmp, qid, err := x.walk(req, dfid, name)
+	if err != nil {
+		return err
+	}
+	isDir := qid.Type&ninep.QTDir != 0
+	if flags&lRemoveDir != 0 && !isDir {
+		err = errNoDir
+	} else if flags&lRemoveDir == 0 && isDir {
+		err = errIsDir
+	}
+	if err != nil {
+		x.clunk(tmp)
+		return err
+	}
+	_, _, err = x.rpc(req, msgTremove, binary.LittleEndian.AppendUint32(nil, tmp))
+	return err
+}
+
+// rename an entry; entries can't be moved to another directory.
+func (x *xlate) rename(req *xreq, ofid uint32, oldname string, nfid uint32, newname string) error {
+	if ofid != nfid {
+		od, err := x.stat(req, ofid)
+		if err != nil {
+			return err
+		}
+		nd, err := x.stat(req, nfid)
+		if err != nil {
+			return err
+		}
+		if od.Qid.Path != nd.Qid.Path {
+			return errXDev
+		}
+	}
+	tmp, _, err := x.walk(req, ofid, oldname)
+	if err != nil {
+		return err
+	}
+	defer x.clunk(tmp)
+	d := dontTouch()
+	d.Name = newname
+	return x.wstat(req, tmp, d)
+}
@@ -0,0 +1,211 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"encoding/binary"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// 9P2000.u file modes not supported by the namespace
+const (
+	uDMSymlink   = 0x02000000 // symbolic link
+	uDMDevice    = 0x00800000 // device file
+	uDMNamedPipe = 0x00200000 // named pipe
+	uDMSocket    = 0x00100000 // socket
+	uDMSpecial   = uDMSymlink | uDMDevice | uDMNamedPipe | uDMSocket
+)
+
+// dotu handles a 9P2000.u client request and returns the response (type
+// and body). The 9P2000.u dialect extends classic messages: users and
+// groups are also given by number, stat entries carry numeric ids and
+// errors carry an error number.
+func (x *xlate) dotu(req *xreq, typ byte, body []byte) (byte, []byte, error) {
+	r := &msgReader{b: body}
+	fid := r.u32()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	switch typ {
+	case msgTwalk, msgTwrite:
+		// same in both dialects
+		return x.rpc(req, typ, body)
+
+	case msgTauth, msgTattach:
+		return x.attach(req, typ, body)
+
+	case msgTclunk, msgTremove:
+		x.forget(fid)
+		return x.rpc(req, typ, body)
+
+	case msgTopen:
+		rtyp, rb, err := x.rpc(req, typ, body)
+		if err == nil {
+			x.opened(fid, rb)
+		}
+		return rtyp, rb, err
+
+	case msgTcreate:
+		// fid[4] name[s] perm[4] mode[1] extension[s]
+		r.str()
+		perm := r.u32()
+		r.u8()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		if perm&uDMSpecial != 0 {
+			return 0, nil, errNotSupp
+		}
+		rtyp, rb, err := x.rpc(req, typ, body[:len(body)-len(r.b)])
+		if err == nil {
+			x.opened(fid, rb)
+		}
+		return rtyp, rb, err
+
+	case msgTread:
+		// fid[4] offset[8] count[4]
+		x.mtx.Lock()
+		dir, ok := x.dirs[fid]
+		x.mtx.Unlock()
+		if !ok {
+			return x.rpc(req, typ, body)
+		}
+		off, count := r.u64(), r.u32()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		b, err := x.readDirU(req, fid, dir, off, count)
+		return msgTread + 1, b, err
+
+	case msgTstat:
+		d, err := x.stat(req, fid)
+		if err != nil {
+			return 0, nil, err
+		}
+		stat := x.encodeDirU(d)
+		b := binary.LittleEndian.AppendUint16(nil, uint16(len(stat)))
+		return msgTstat + 1, append(b, stat...), nil
+
+	case msgTwstat:
+		// fid[4] size[2] stat[n]
+		r.next(2)
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		d, err := x.decodeDirU(r.b)
+		if err != nil {
+			return 0, nil, err
+		}
+		return msgTwstat + 1, nil, x.wstat(req, fid, d)
+	}
+	return 0, nil, errNotSupp
+}
+
+// opened remembers fids of opened directories (from the Qid in the
+// response) for directory reads.
+func (x *xlate) opened(fid uint32, rb []byte) {
+	if len(rb) < 13 || decodeQid(rb).Type&ninep.QTDir == 0 {
+		return
+	}
+	x.mtx.Lock()
+	x.dirs[fid] = new(listing)
+	x.mtx.Unlock()
+}
+
+// readDirU reads 9P2000.u stat entries of an opened directory. The
+// listing is read when the directory is read from the start; all other
+// reads must continue where the last read ended.
+func (x *xlate) readDirU(req *xreq, fid uint32, dir *listing, off uint64, count uint32) ([]byte, error) {
+	x.mtx.Lock()
+	list, next, pos := dir.list, dir.next, dir.off
+	x.mtx.Unlock()
+	if off == 0 {
+		var err error
+		if list, err = x.list(req, fid); err != nil {
+			return nil, err
+		}
+		next, pos = 0, 0
+	} else if off != pos {
+		return nil, errOffset
+	}
+	b := make([]byte, 4)
+	for ; next < len(list); next++ {
+		stat := x.encodeDirU(&list[next])
+		if len(b)-4+len(stat) > int(count) {
+			break
+		}
+		b = append(b, stat...)
+	}
+	if len(b) == 4 && next < len(list) {
+		return nil, errShort
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+
+	x.mtx.Lock()
+	dir.list, dir.next, dir.off = list, next, pos+uint64(len(b)-4)
+	x.mtx.Unlock()
+	return b, nil
+}
+
+// encodeDirU encodes a 9P2000.u stat entry: a classic stat entry followed
+// by extension[s] n_uid[4] n_gid[4] n_muid[4].
+func (x *xlate) encodeDirU(d *ninep.Dir) []byte {
+	b := appendStr(encodeDir(d), "")
+	for _, name := range []string{d.Uid, d.Gid, d.Muid} {
+		b = binary.LittleEndian.AppendUint32(b, x.id(name))
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(b)-2))
+	return b
+}
+
+// decodeDirU decodes a 9P2000.u stat entry. Users and groups only given
+// by number are named from their ids.
+func (x *xlate) decodeDirU(b []byte) (*ninep.Dir, error) {
+	d, _, err := decodeDir(b)
+	if err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint16(b)) + 2
+	r := &msgReader{b: b[dirSize(d):size]}
+	r.str()
+	uid, gid := r.u32(), r.u32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	for _, id := range []struct {
+		id   uint32
+		name *string
+	}{
+		{uid, &d.Uid},
+		{gid, &d.Gid},
+	} {
+		if len(*id.name) > 0 || id.id == noUID {
+			continue
+		}
+		name, ok := x.name(id.id)
+		if !ok {
+			return nil, errPerm
+		}
+		*id.name = name
+	}
+	return d, nil
+}
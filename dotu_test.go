@@ -0,0 +1,52 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"testing"
+)
+
+// TestDotU replays 9P2000.u message sequences from testdata/dotu (see
+// replayAll).
+func TestDotU(t *testing.T) {
+	replayAll(t, "testdata/dotu", func(ns *Namespace) {
+		ns.SetID("sys", 100)
+	})
+}
+
+func TestNamespaceIDs(t *testing.T) {
+	ns := NewNamespace("sys", "adm")
+	ns.SetID("sys", 100)
+	root, err := ns.Get("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := root.IDs(); uid != 100 || gid != nobody {
+		t.Fatalf("ids: %d, %d", uid, gid)
+	}
+	ns.SetID("adm", 4)
+	if uid, gid := root.IDs(); uid != 100 || gid != 4 {
+		t.Fatalf("ids: %d, %d", uid, gid)
+	}
+	if name, ok := ns.idName(4); !ok || name != "adm" {
+		t.Fatalf("name: %q", name)
+	}
+}
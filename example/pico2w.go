@@ -27,7 +27,6 @@ import (
 	"strconv"
 	"time"
 
-	"git.sr.ht/~moody/ninep"
 	"github.com/bfix/srv9p"
 )
 
@@ -36,13 +35,16 @@ import (
 //
 //	-ldflags "-X 'main.SSID=MyWiFi' -X 'main.Passwd=MySecret' -X 'main.Host=pico' -X 'main.Port=564'"
 //
-// to the build/install command.
+// to the build/install command. Setting a pre-shared key for TLS
+// ('main.PSK=...') requires TLS support on the device: the server
+// refuses to start instead of serving 9p in clear.
 var (
 	SSID   string
 	Passwd string
 	Host   string
 	IP     string
 	Port   string
+	PSK    string
 )
 
 // run 9p server
@@ -70,6 +72,9 @@ func main() {
 		},
 	)))
 
+	// small messages and a RAM budget for (up to three) sessions
+	fs.SetLimits(srv9p.Limits{Msize: 2048, Budget: 16 * 1024})
+
 	// connect to WiFi and listen to 9p connections
 	port, err := strconv.ParseInt(Port, 10, 16)
 	if err != nil {
@@ -81,16 +86,22 @@ func main() {
 		state.Set(stat, 0)
 		return
 	}
-
-	// serve filesystem via 9p
-	for {
-		c, err := lst.Accept()
-		if err != nil {
-			state.Set(srv9p.StatSRV, 3)
-			continue
+	if PSK != "" {
+		if lst, err = srv9p.ListenTLS(lst, &srv9p.TLSConfig{PSK: []byte(PSK)}); err != nil {
+			fmt.Printf("TLS: %v\n", err)
+			state.Set(srv9p.StatLISTEN2, 0)
+			return
 		}
-		srv := ninep.NewSrv(func() ninep.FS { return fs })
-		go srv.ServeIO(c, c)
+	}
+
+	// serve filesystem via 9p (closing connections idle for 10 minutes);
+	// halt with the status shown if the listener fails.
+	srv := srv9p.NewServer(fs, lst, state)
+	srv.IdleTimeout = 10 * time.Minute
+	if err = srv.Serve(); err != nil {
+		fmt.Printf("SRV: %v\n", err)
+		state.Set(srv9p.StatSRV, 0)
+		return
 	}
 
 	// srv tcp!<host>!9fs test
@@ -20,6 +20,13 @@
 
 package srv9p
 
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
 // File interface for file handler implementations:
 // The interface methods are called by the 9p protocol handler on demand.
 // The implementation is free to handle the read/write calls according
@@ -29,6 +36,60 @@ type File interface {
 	Write([]byte) error
 }
 
+// Files with large or generated content can implement io.ReaderAt and/or
+// io.WriterAt in addition to the File interface: the 9p handlers then
+// use these methods to process only the requested part of the content
+// instead of the complete file content.
+
+// Sizer is an optional interface for files that know the size of their
+// content without reading it (size hint).
+type Sizer interface {
+	Size() int64
+}
+
+// Volatile is an optional interface for files with content that changes
+// without being written (like generated content). Volatile files report
+// a new Qid version and the current time as modification time whenever
+// they are opened or stat'ed, so clients don't cache their content; the
+// length is only reported if the file implements Sizer.
+type Volatile interface {
+	Volatile() bool
+}
+
+// Handler is an optional interface for files that manage per-open state:
+// the file returned by Handle() is used for all operations on an opened
+// fid until the fid is clunked.
+type Handler interface {
+	Handle() (File, error)
+}
+
+// Poller is an optional interface for files with blocking reads (like
+// event files): a read on an opened fid waits for Poll to return the
+// data. Poll must return when the context is canceled (the client has
+// flushed the request or clunked the fid). Offsets are ignored; data
+// exceeding the requested count is truncated.
+type Poller interface {
+	Poll(ctx context.Context) ([]byte, error)
+}
+
+// Opener is an optional interface for files that want to be notified when
+// a client opens them (with the requested open mode). Returning an error
+// rejects the open request. Files that need to be notified when an opened
+// fid is clunked implement io.Closer.
+type Opener interface {
+	Open(mode byte) error
+}
+
+// ContextFile is an optional interface for files that need to know on
+// whose behalf they are read or written (like files with user-specific
+// content or audited actions): the methods are called instead of Read and
+// Write for client requests. ClientFrom returns the client information
+// from the context; the context passed to Poll carries it too.
+type ContextFile interface {
+	ReadContext(ctx context.Context) ([]byte, error)
+	WriteContext(ctx context.Context, data []byte) error
+}
+
 //----------------------------------------------------------------------
 
 // NopFile ignores all read/write requests
@@ -64,6 +125,11 @@ func (f *TextFile) Read() ([]byte, error) {
 	return []byte(f.body), nil
 }
 
+// Size of file content.
+func (f *TextFile) Size() int64 {
+	return int64(len(f.body))
+}
+
 //----------------------------------------------------------------------
 
 // FuncFile content is returned by a function.
@@ -83,3 +149,209 @@ func NewFuncFile(fcn func() ([]byte, error)) *FuncFile {
 func (f *FuncFile) Read() ([]byte, error) {
 	return f.fcn()
 }
+
+// Volatile implementation: content is generated on every read.
+func (f *FuncFile) Volatile() bool {
+	return true
+}
+
+//----------------------------------------------------------------------
+
+// StreamFile serves (large) read-only content from an io.ReaderAt.
+type StreamFile struct {
+	NopFile
+	r    io.ReaderAt
+	size int64
+}
+
+// NewStreamFile for content of given size accessed by a reader.
+func NewStreamFile(r io.ReaderAt, size int64) *StreamFile {
+	return &StreamFile{
+		r:    r,
+		size: size,
+	}
+}
+
+// Read implementation: return complete file content.
+func (f *StreamFile) Read() ([]byte, error) {
+	data := make([]byte, f.size)
+	n, err := f.r.ReadAt(data, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// ReadAt implementation: return part of the file content.
+func (f *StreamFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+// Size of file content.
+func (f *StreamFile) Size() int64 {
+	return f.size
+}
+
+//----------------------------------------------------------------------
+
+// MemFile is an in-memory file with read/write content. It can be
+// shared between concurrent sessions.
+type MemFile struct {
+	data []byte
+	mem  *budget // limits of the namespace of the file (or nil)
+	mtx  sync.RWMutex
+}
+
+// NewMemFile with given initial content.
+func NewMemFile(content []byte) *MemFile {
+	return &MemFile{
+		data: content,
+	}
+}
+
+// Read implementation: return a copy of the file content.
+func (f *MemFile) Read() ([]byte, error) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return bytes.Clone(f.data), nil
+}
+
+// Write implementation: replace file content.
+func (f *MemFile) Write(data []byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.data = bytes.Clone(data)
+	return nil
+}
+
+// ReadAt implementation: return part of the file content.
+func (f *MemFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	if off < 0 {
+		return 0, errRange
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implementation: write data at given offset. The offset may
+// exceed the size of the content by the growth limit of the namespace
+// the file is added to (see Limits.Growth).
+func (f *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if off < 0 {
+		return 0, errRange
+	}
+	if off > int64(len(f.data))+f.mem.growth() {
+		return 0, errGrowth
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// limit the growth of the file by the limits of a namespace (unless the
+// file is already limited).
+func (f *MemFile) limit(mem *budget) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.mem == nil {
+		f.mem = mem
+	}
+}
+
+// Size of file content.
+func (f *MemFile) Size() int64 {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return int64(len(f.data))
+}
+
+//----------------------------------------------------------------------
+
+// EventFile delivers events (like button presses or alerts) to clients:
+// a read on an opened event file blocks until the next event is posted.
+// Each fid receives all events posted while it is open; unread events
+// are queued (up to a limit, dropping the oldest).
+type EventFile struct {
+	NopFile
+	size int                      // max. number of queued events per fid
+	subs map[*eventQueue]struct{} // queues of opened fids
+	mtx  sync.Mutex
+}
+
+// NewEventFile with given queue size per opened fid.
+func NewEventFile(size int) *EventFile {
+	return &EventFile{
+		size: max(size, 1),
+		subs: make(map[*eventQueue]struct{}),
+	}
+}
+
+// Post an event to all opened fids.
+func (f *EventFile) Post(ev []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for q := range f.subs {
+		select {
+		case q.ch <- ev:
+			continue
+		default:
+		}
+		// queue full: drop oldest event
+		select {
+		case <-q.ch:
+		default:
+		}
+		q.ch <- ev
+	}
+}
+
+// Handle implementation: create an event queue for an opened fid.
+func (f *EventFile) Handle() (File, error) {
+	q := &eventQueue{
+		f:  f,
+		ch: make(chan []byte, f.size),
+	}
+	f.mtx.Lock()
+	f.subs[q] = struct{}{}
+	f.mtx.Unlock()
+	return q, nil
+}
+
+// eventQueue holds the events for an opened fid.
+type eventQueue struct {
+	NopFile
+	f  *EventFile
+	ch chan []byte
+}
+
+// Poll implementation: wait for next event.
+func (q *eventQueue) Poll(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case ev := <-q.ch:
+		return ev, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close implementation: stop receiving events.
+func (q *eventQueue) Close() error {
+	q.f.mtx.Lock()
+	defer q.f.mtx.Unlock()
+	delete(q.f.subs, q)
+	return nil
+}
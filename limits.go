@@ -0,0 +1,139 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"errors"
+	"sync"
+)
+
+// Message sizes
+const (
+	minMsize  = 256               // smallest message size granted by a memory budget
+	maxMsize  = 65536 + ioHdrSize // largest message size granted without limits
+	ioHdrSize = 24                // header size of Tread/Rread and Twrite (IOHDRSZ)
+	connCost  = 1024              // memory used by a connection (besides messages)
+)
+
+// default growth of a file beyond its current size in a write or wstat
+const defGrowth = 1 << 20
+
+// Error messages
+var (
+	errBudget = errors.New("not enough memory for session")
+	errGrowth = errors.New("file too large")
+)
+
+// Limits restrict the resources used by client connections on devices
+// with little RAM. A zero value means no limit (or the default).
+type Limits struct {
+	// Msize is the largest message size granted to clients in Tversion
+	// (0: 64 KiB plus header). File iounits are derived from the
+	// negotiated message size.
+	Msize uint32
+
+	// Budget is the memory (in bytes) available for all connections.
+	// A connection is accounted with a fixed overhead plus two messages
+	// (request and response); the message size of a new session is
+	// reduced to fit the budget and the session is rejected if the
+	// remaining memory is too small.
+	Budget int
+
+	// Growth is the largest number of bytes a write or wstat may extend
+	// a file beyond its current size (0: 1 MiB). The content of files
+	// that are not written in place is held in memory when written.
+	Growth int64
+}
+
+// SetLimits sets the resource limits for new sessions.
+func (ns *Namespace) SetLimits(lim Limits) {
+	ns.mem.mtx.Lock()
+	defer ns.mem.mtx.Unlock()
+	ns.mem.lim = lim
+}
+
+// budget accounts the memory used by connections.
+type budget struct {
+	lim  Limits     // resource limits
+	used int        // memory reserved by connections
+	mtx  sync.Mutex // lock for limits and usage
+}
+
+// alloc reserves memory for a session with the message size requested
+// by a client; prev is the reservation of a previous session on the same
+// connection. Returns the granted message size and the new reservation.
+func (m *budget) alloc(want uint32, prev int) (msize uint32, cost int, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.used -= prev
+	msize = min(want, maxMsize)
+	if m.lim.Msize > 0 {
+		msize = min(want, m.lim.Msize)
+	}
+	if m.lim.Budget > 0 {
+		avail := max(m.lim.Budget-m.used-connCost, 0)
+		msize = uint32(min(int(msize), avail/2))
+		if msize < min(want, minMsize) {
+			m.used += prev
+			return 0, prev, errBudget
+		}
+		cost = connCost + 2*int(msize)
+	}
+	m.used += cost
+	return
+}
+
+// release the reservation of a connection.
+func (m *budget) release(cost int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.used -= cost
+}
+
+// growth returns the largest allowed extension of a file (the default
+// if there is no budget).
+func (m *budget) growth() int64 {
+	if m == nil {
+		return defGrowth
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.lim.Growth > 0 {
+		return m.lim.Growth
+	}
+	return defGrowth
+}
+
+// limit returns the largest request accepted on a connection with given
+// negotiated message size (0: not negotiated). Before negotiation only
+// small requests (like Tversion) are accepted if limits are set and no
+// request exceeds the largest message size otherwise.
+func (m *budget) limit(msize uint32) uint32 {
+	if msize > 0 {
+		return msize
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.lim.Msize > 0 || m.lim.Budget > 0 {
+		return minMsize
+	}
+	return maxMsize
+}
@@ -0,0 +1,262 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialLimited connects to a namespace and negotiates the protocol version
+// with given message size; returns the granted message size.
+func dialLimited(t *testing.T, ns *Namespace, msize uint32) (*testClient, uint32, error) {
+	t.Helper()
+	srv, cli := net.Pipe()
+	go ns.ServeConn(srv)
+	c := &testClient{t: t, conn: cli, tag: 0xffff}
+	var b msgBuf
+	_, r, err := c.rpc(msgTversion, b.u32(msize).str("9P2000"))
+	if err != nil {
+		cli.Close()
+		return nil, 0, err
+	}
+	return c, binary.LittleEndian.Uint32(r), nil
+}
+
+func TestLimitsMsize(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	if err = ns.NewFile("/blob", 0444, NewMemFile(content)); err != nil {
+		t.Fatal(err)
+	}
+	ns.SetLimits(Limits{Msize: 1024})
+
+	c, msize, err := dialLimited(t, ns, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msize != 1024 {
+		t.Fatalf("msize %d", msize)
+	}
+	if err = c.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(0, 1, "blob"); err != nil {
+		t.Fatal(err)
+	}
+	_, iounit, err := c.open(1, OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iounit != msize-ioHdrSize {
+		t.Fatalf("iounit %d", iounit)
+	}
+	// read count capped by message size
+	data, err := c.read(1, 0, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != int(iounit) || !bytes.Equal(data, content[:iounit]) {
+		t.Fatalf("read %d bytes", len(data))
+	}
+	// oversized requests drop the connection
+	var b msgBuf
+	b = b.u32(hdrSize + 16 + 2048).u8(msgTwrite).u16(1).u32(1).u64(0).u32(2048)
+	if _, err = c.conn.Write(append(b, make([]byte, 2048)...)); err == nil {
+		t.Fatal("oversized request accepted")
+	}
+}
+
+func TestLimitsBudget(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.SetLimits(Limits{Budget: connCost + 2*2048})
+
+	// first session gets the budget
+	c1, msize, err := dialLimited(t, ns, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msize != 2048 {
+		t.Fatalf("msize %d", msize)
+	}
+	// second session is rejected
+	if _, _, err = dialLimited(t, ns, 8192); err == nil || err.Error() != errBudget.Error() {
+		t.Fatalf("second session: %v", err)
+	}
+	// budget is released when the first connection is closed
+	c1.conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c2, msize, err := dialLimited(t, ns, 8192)
+		if err == nil {
+			if msize != 2048 {
+				t.Fatalf("msize %d", msize)
+			}
+			if err = c2.attach(0, nofid, "glenda"); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimitsGrowth(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bufFile{data: []byte("hello")}
+	if err = ns.NewFile("/buf", 0666, buf); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "buf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(1, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	// huge offsets are rejected
+	if _, err = c.write(1, 1<<62, []byte("x")); err == nil || err.Error() != errGrowth.Error() {
+		t.Fatalf("write at huge offset: %v", err)
+	}
+	// configured growth
+	ns.SetLimits(Limits{Growth: 16})
+	if _, err = c.write(1, 5+17, []byte("x")); err == nil || err.Error() != errGrowth.Error() {
+		t.Fatalf("write beyond growth: %v", err)
+	}
+	if _, err = c.write(1, 5+16, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if len(buf.data) != 22 {
+		t.Fatalf("size %d", len(buf.data))
+	}
+}
+
+func TestLimitsDefault(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := new(genReader)
+	if err = ns.NewFile("/blob", 0444, NewStreamFile(gen, 1<<30)); err != nil {
+		t.Fatal(err)
+	}
+	// message size is capped without limits
+	c, msize, err := dialLimited(t, ns, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msize != maxMsize {
+		t.Fatalf("msize %d", msize)
+	}
+	if err = c.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(0, 1, "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	// read count capped by message size
+	data, err := c.read(1, 0, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != maxMsize-ioHdrSize {
+		t.Fatalf("read %d bytes", len(data))
+	}
+	// offsets beyond the range of io.ReaderAt
+	if _, err = c.read(1, 1<<63, 16); err == nil || err.Error() != errRange.Error() {
+		t.Fatalf("read at huge offset: %v", err)
+	}
+}
+
+func TestLimitsUnversioned(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// oversized request before Tversion (no limits set)
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	done := make(chan struct{})
+	go func() {
+		ns.ServeConn(srv)
+		close(done)
+	}()
+	var hdr [hdrSize]byte
+	binary.LittleEndian.PutUint32(hdr[:], 1<<30)
+	hdr[4] = msgTversion
+	if _, err = cli.Write(hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized request accepted")
+	}
+}
+
+func TestLimitsMemFile(t *testing.T) {
+	f := NewMemFile([]byte("hello"))
+	if _, err := f.WriteAt([]byte("x"), -1); err != errRange {
+		t.Fatalf("negative offset: %v", err)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), -1); err != errRange {
+		t.Fatalf("negative offset: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 1<<62); err != errGrowth {
+		t.Fatalf("huge offset: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 5+defGrowth); err != nil {
+		t.Fatal(err)
+	}
+	if f.Size() != 6+defGrowth {
+		t.Fatalf("size %d", f.Size())
+	}
+	// growth limit of the namespace
+	ns := NewNamespace("sys", "sys")
+	ns.SetLimits(Limits{Growth: 2 * defGrowth})
+	if err := ns.NewFile("/mem", 0666, f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), f.Size()+2*defGrowth); err != nil {
+		t.Fatal(err)
+	}
+	ns.SetLimits(Limits{Growth: 16})
+	if _, err := f.WriteAt([]byte("x"), f.Size()+17); err != errGrowth {
+		t.Fatalf("write beyond growth: %v", err)
+	}
+}
@@ -22,26 +22,71 @@ package srv9p
 
 import (
 	"errors"
+	"io"
+	"net"
+	gopath "path"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"git.sr.ht/~moody/ninep"
 )
 
+// Open modes (Topen, Tcreate)
+const (
+	OREAD   = 0    // open for read
+	OWRITE  = 1    // open for write
+	ORDWR   = 2    // open for read and write
+	OEXEC   = 3    // open for execute
+	OTRUNC  = 0x10 // truncate file first
+	ORCLOSE = 0x40 // remove on clunk
+)
+
 // Error messages
 var (
 	errNoRoot = errors.New("no root directory")
 	errNoFile = errors.New("no such file or directory")
 	errNoDir  = errors.New("not a directory")
 	errNoAbs  = errors.New("no absolute path")
+	errIsDir  = errors.New("is a directory")
+	errPerm   = errors.New("permission denied")
+	errOpen   = errors.New("file already open")
+	errExists = errors.New("file already exists")
+	errName   = errors.New("invalid file name")
+	errEmpty  = errors.New("directory not empty")
+	errExcl   = errors.New("exclusive use file already open")
 )
 
 //----------------------------------------------------------------------
 
+// CreateFunc is called when a client creates a new entry with given name
+// and permissions in a directory. It returns the file implementation for
+// a new file or an error if the creation is rejected. For directories
+// (DMDir set in perm) the returned file is ignored.
+type CreateFunc func(name string, perm uint32) (File, error)
+
+// WstatFunc is called when a client changes the stat of an entry (see
+// Twstat for "don't touch" values). Returning an error rejects all changes.
+type WstatFunc func(d *ninep.Dir) error
+
+// RemoveFunc is called when a client removes an entry. Returning an
+// error rejects the removal.
+type RemoveFunc func() error
+
 // Entry in the filesystem
 type Entry struct {
+	ns       *Namespace        // namespace of the entry
+	parent   *Entry            // parent directory (nil for root)
 	ref      *ninep.Dir        // 9p reference
 	children map[string]*Entry // list of children (for folders) or nil
 	file     File              // file implementation or nil (for folders)
+	list     DirFunc           // listing function (dynamic folders) or nil
+	create   CreateFunc        // create handler (for folders) or nil
+	remove   RemoveFunc        // remove handler or nil
+	wstat    WstatFunc         // wstat handler or nil
+	clone    *conv             // resource directory of a clone file or nil
+	amtx     sync.Mutex        // serialize appends (DMAppend)
 }
 
 // IsDir returns true if entry is a directory
@@ -51,19 +96,84 @@ func (e *Entry) IsDir() bool {
 
 // SetOwner of entry if different from namespace owner
 func (e *Entry) SetOwner(user, group string) {
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
 	e.ref.Uid = user
 	e.ref.Gid = group
 }
 
+// IDs returns the numeric ids of owner and group of the entry (see
+// Namespace.SetID).
+func (e *Entry) IDs() (uid, gid uint32) {
+	e.ns.mtx.RLock()
+	user, group := e.ref.Uid, e.ref.Gid
+	e.ns.mtx.RUnlock()
+	return e.ns.numID(user), e.ns.numID(group)
+}
+
+// Modified marks the content of the entry as changed: Go code that changes
+// file content without writing it through the namespace calls Modified to
+// update the modification time and Qid version seen by clients.
+func (e *Entry) Modified() {
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
+	e.modified("")
+}
+
+// SetCreator allows clients to create new entries in a directory. The
+// function is inherited by subdirectories created by clients.
+func (e *Entry) SetCreator(fcn CreateFunc) error {
+	if !e.IsDir() {
+		return errNoDir
+	}
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
+	e.create = fcn
+	return nil
+}
+
+// SetRemover sets a handler that decides if clients can remove the entry.
+func (e *Entry) SetRemover(fcn RemoveFunc) {
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
+	e.remove = fcn
+}
+
+// SetWstat sets a handler that decides if clients can change the stat
+// (name, mode, ownership,...) of the entry.
+func (e *Entry) SetWstat(fcn WstatFunc) {
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
+	e.wstat = fcn
+}
+
 //----------------------------------------------------------------------
 
-// Namespace is a synthetic filesystem.
+// GroupFunc checks if a user is a member of a group.
+type GroupFunc func(user, group string) bool
+
+// Namespace is a synthetic filesystem. It can be served to concurrent
+// 9p sessions and modified while sessions are active. Handlers (file
+// implementations and entry hooks) are called without the namespace
+// being locked and can modify the namespace.
 type Namespace struct {
-	ninep.NopFS                   // use default handlers where needed
-	user        string            // namespace owner
-	group       string            // owner group
-	dict        map[uint64]*Entry // map Qid.Path to filesystem entry
-	nextID      uint64            // identifier for an entry
+	user   string                 // namespace owner
+	group  string                 // owner group
+	dict   map[uint64]*Entry      // map Qid.Path to filesystem entry
+	nextID uint64                 // identifier for an entry
+	mtx    sync.RWMutex           // lock for the filesystem tree
+	mounts map[*Entry][]*Entry    // members of union directories (binds)
+	keys   map[*Entry]*Entry      // union directory of a member
+	alias  map[uint64]bound       // Qid.Path to entry of bound namespace
+	local  map[bound]uint64       // entry of bound namespace to Qid.Path
+	groups GroupFunc              // group membership resolver
+	ids    map[string]uint32      // numeric ids of users and groups
+	auth   AuthProto              // authentication protocol (or nil)
+	gmtx   sync.Mutex             // lock for group resolver, ids and auth
+	open   map[*ninep.Qid]*handle // handles of opened fids
+	excl   map[*Entry]bool        // opened exclusive-use entries (DMExcl)
+	hmtx   sync.Mutex             // lock for handles
+	mem    budget                 // memory accounting for connections
 }
 
 // NewNamespace creates a new filesystem (with root directory) for the given
@@ -72,15 +182,79 @@ type Namespace struct {
 // SetOwner() method of an entry.
 func NewNamespace(user, group string) *Namespace {
 	ns := &Namespace{
-		dict:  make(map[uint64]*Entry),
-		user:  user,
-		group: group,
+		dict:   make(map[uint64]*Entry),
+		mounts: make(map[*Entry][]*Entry),
+		keys:   make(map[*Entry]*Entry),
+		alias:  make(map[uint64]bound),
+		local:  make(map[bound]uint64),
+		open:   make(map[*ninep.Qid]*handle),
+		excl:   make(map[*Entry]bool),
+		ids:    make(map[string]uint32),
+		user:   user,
+		group:  group,
 	}
 	e := ns.newEntry("/", user, group, 0555, nil)
 	ns.dict[e.ref.Path] = e
 	return ns
 }
 
+// SetGroups sets the resolver for group memberships used in permission
+// checks. By default a user is only member of the group with the same
+// name as the user.
+func (ns *Namespace) SetGroups(fcn GroupFunc) {
+	ns.gmtx.Lock()
+	defer ns.gmtx.Unlock()
+	ns.groups = fcn
+}
+
+// member returns true if user is a member of group.
+func (ns *Namespace) member(user, group string) bool {
+	ns.gmtx.Lock()
+	fcn := ns.groups
+	ns.gmtx.Unlock()
+	if fcn != nil {
+		return fcn(user, group)
+	}
+	return user == group
+}
+
+// SetID assigns a numeric id to a user or group name: clients using the
+// 9P2000.u or 9P2000.L dialect identify users and groups by number. Names
+// without an id are reported as user "nobody" (65534).
+func (ns *Namespace) SetID(name string, id uint32) {
+	ns.gmtx.Lock()
+	defer ns.gmtx.Unlock()
+	ns.ids[name] = id
+}
+
+// id returns the numeric id of a user or group.
+func (ns *Namespace) id(name string) (uint32, bool) {
+	ns.gmtx.Lock()
+	defer ns.gmtx.Unlock()
+	id, ok := ns.ids[name]
+	return id, ok
+}
+
+// numID returns the numeric id of a user or group (or nobody).
+func (ns *Namespace) numID(name string) uint32 {
+	if id, ok := ns.id(name); ok {
+		return id
+	}
+	return nobody
+}
+
+// idName returns the user or group name for a numeric id.
+func (ns *Namespace) idName(id uint32) (string, bool) {
+	ns.gmtx.Lock()
+	defer ns.gmtx.Unlock()
+	for name, v := range ns.ids {
+		if v == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
 // get next identifier for an entry.
 func (ns *Namespace) newId() uint64 {
 	id := ns.nextID
@@ -91,157 +265,331 @@ func (ns *Namespace) newId() uint64 {
 // Create a new entry in the filesystem.
 // If impl is nil, the entry represents a directory; otherwise a file.
 func (ns *Namespace) newEntry(name, user, group string, perm uint32, impl File) *Entry {
-	e := new(Entry)
-	kind := ninep.QTFile
+	e := &Entry{ns: ns}
 	if impl == nil {
-		kind = ninep.QTDir
 		e.children = make(map[string]*Entry)
 		perm |= ninep.DMDir
 	} else {
 		e.file = impl
+		perm &^= ninep.DMDir
+		if mf, ok := impl.(*MemFile); ok {
+			mf.limit(&ns.mem)
+		}
 	}
+	t := now()
 	e.ref = &ninep.Dir{
 		Qid: ninep.Qid{
 			Path: ns.newId(),
 			Vers: 0,
-			Type: byte(kind),
+			Type: qidType(perm),
 		},
-		Name: name,
-		Mode: perm,
-		Uid:  user,
-		Gid:  group,
-		Muid: user,
+		Name:  name,
+		Mode:  perm,
+		Atime: t,
+		Mtime: t,
+		Uid:   user,
+		Gid:   group,
+		Muid:  user,
 	}
 	return e
 }
 
-// Get entry with given path
-func (ns *Namespace) Get(path string) (*Entry, error) {
-	if path[0] != '/' {
+// qidType returns the Qid type for given permissions: the supported
+// mode bits DMDir, DMAppend, DMExcl and DMTmp are mirrored in the type.
+func qidType(perm uint32) uint8 {
+	return uint8(perm>>24) & (ninep.QTDir | ninep.QTAppend | ninep.QTExcl | ninep.QTTemp)
+}
+
+// modified updates the modification time and Qid version of an entry
+// changed by user (namespace locked by caller).
+func (e *Entry) modified(user string) {
+	e.ref.Mtime = now()
+	e.ref.Vers++
+	if len(user) > 0 {
+		e.ref.Muid = user
+	}
+}
+
+// accessed updates the access time of an entry.
+func (e *Entry) accessed() {
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
+	e.ref.Atime = now()
+}
+
+// stat returns the current stat of an entry. The length of a file is
+// taken from its size hint (Sizer), the content snapshot of an opened fid
+// (if not nil) or its content; streams (io.ReaderAt) without size hint
+// are not read and report a length of 0 like volatile files. Volatile
+// files get a new version.
+func (e *Entry) stat(snap []byte) ninep.Dir {
+	volatile := false
+	if v, ok := e.file.(Volatile); ok {
+		volatile = v.Volatile()
+	}
+	e.ns.mtx.Lock()
+	if volatile {
+		e.modified("")
+	}
+	d := *e.ref
+	e.ns.mtx.Unlock()
+
+	switch f := e.file.(type) {
+	case nil:
+	case Sizer:
+		d.Len = uint64(f.Size())
+	case io.ReaderAt:
+	default:
+		if volatile {
+			break
+		}
+		if snap != nil {
+			d.Len = uint64(len(snap))
+		} else if data, err := f.Read(); err == nil {
+			d.Len = uint64(len(data))
+		}
+	}
+	return d
+}
+
+// now returns the current time in 9p format.
+func now() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// Get entry with given path. Empty and "." path elements are ignored,
+// ".." refers to the parent directory. Dynamic directories on the path
+// are refreshed and binds are followed.
+func (ns *Namespace) Get(path string) (curr *Entry, err error) {
+	if len(path) == 0 || path[0] != '/' {
 		return nil, errNoAbs
 	}
-	curr := ns.dict[0]
+	ns.mtx.RLock()
+	curr = ns.dict[0]
+	ns.mtx.RUnlock()
 	for _, label := range strings.Split(path[1:], "/") {
-		if len(label) == 0 {
+		if len(label) == 0 || label == "." {
 			continue
 		}
-		if curr.children == nil {
+		if !curr.IsDir() {
 			return nil, errNoDir
 		}
-		qid := ns.Walk(&curr.ref.Qid, label)
-		if qid == nil {
+		if curr = ns.next(curr, label); curr == nil {
 			return nil, errNoFile
 		}
-		e, ok := ns.dict[qid.Path]
-		if !ok {
-			return nil, errNoFile
+	}
+	return
+}
+
+// get entry with given path (namespace locked by caller).
+func (ns *Namespace) get(path string) (curr *Entry, err error) {
+	if len(path) == 0 || path[0] != '/' {
+		return nil, errNoAbs
+	}
+	curr = ns.dict[0]
+	for _, label := range strings.Split(path[1:], "/") {
+		if len(label) == 0 || label == "." {
+			continue
+		}
+		if curr, err = ns.step(curr, label); err != nil {
+			return nil, err
 		}
-		curr = e
 	}
-	return curr, nil
+	return
+}
+
+// step from a directory to the entry with given name.
+func (ns *Namespace) step(e *Entry, name string) (*Entry, error) {
+	if !e.IsDir() {
+		return nil, errNoDir
+	}
+	if e = ns.walk(e, name); e == nil {
+		return nil, errNoFile
+	}
+	return e, nil
+}
+
+// walk to child entry with given name; ".." walks to the parent
+// directory (the parent of root is root). Returns nil if the entry is
+// not a directory or has no child with that name.
+func (ns *Namespace) walk(e *Entry, name string) *Entry {
+	if e == nil || !e.IsDir() {
+		return nil
+	}
+	if name == ".." {
+		if e.parent == nil {
+			return e
+		}
+		return e.parent
+	}
+	return e.children[name]
 }
 
 func (ns *Namespace) NewFile(path string, perm uint32, impl File) (err error) {
-	if path[0] != '/' {
+	if len(path) == 0 || path[0] != '/' {
 		return errNoAbs
 	}
-	path = strings.TrimRight(path, "/")
-	idx := strings.LastIndex(path, "/")
-	dir := path[:max(1, idx)]
-	name := path[idx+1:]
+	dir, name := split(path)
+	if !validName(name) {
+		return errName
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
 	return ns.new(dir, ns.newEntry(name, ns.user, ns.group, perm, impl))
 }
 
 // NewDir creates a directory entry for the filesystem.
 func (ns *Namespace) NewDir(path string, perm uint32) (err error) {
-	if path[0] != '/' {
+	if len(path) == 0 || path[0] != '/' {
 		return errNoAbs
 	}
-	path = strings.TrimRight(path, "/")
-	idx := strings.LastIndex(path, "/")
-	dir := path[:max(1, idx)]
-	name := path[idx+1:]
+	dir, name := split(path)
+	if !validName(name) {
+		return errName
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
 	return ns.new(dir, ns.newEntry(name, ns.user, ns.group, perm, nil))
 }
 
 // New inserts an entry at a given directory path.
 func (ns *Namespace) new(path string, entry *Entry) (err error) {
 	var parent *Entry
-	if parent, err = ns.Get(path); err != nil {
+	if parent, err = ns.get(path); err != nil {
 		return
 	}
 	if !parent.IsDir() {
 		err = errNoDir
 		return
 	}
-	parent.children[entry.ref.Name] = entry
-	ns.dict[entry.ref.Path] = entry
+	if parent.list != nil {
+		// content of dynamic directories is generated
+		err = errPerm
+		return
+	}
+	ns.insert(parent, entry)
 	return nil
 }
 
-// Serve the 9p protocol for the given listen string
-func (ns *Namespace) Serve(listen string) error {
-	srv := ninep.NewSrv(func() ninep.FS { return ns })
-	return srv.ListenAndServe(listen)
+// insert an entry into a directory.
+func (ns *Namespace) insert(parent, entry *Entry) {
+	parent.children[entry.ref.Name] = entry
+	entry.parent = parent
+	ns.dict[entry.ref.Path] = entry
+	parent.modified(entry.ref.Uid)
 }
 
-// ninep FS implementation
+// Remove entry with given path from the namespace. Directories must be
+// empty unless recursive is set; in that case the complete subtree is
+// removed.
+func (ns *Namespace) Remove(path string, recursive bool) error {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	e, err := ns.get(path)
+	if err != nil {
+		return err
+	}
+	return ns.remove(e, recursive)
+}
 
-// Attach to 9p session
-func (ns *Namespace) Attach(t *ninep.Tattach) {
-	if e, ok := ns.dict[0]; ok {
-		t.Respond(&e.ref.Qid)
-	} else {
-		t.Err(errNoRoot)
+// remove an entry from its parent directory.
+func (ns *Namespace) remove(e *Entry, recursive bool) error {
+	if ns.dict[e.ref.Path] != e {
+		return errNoFile
+	}
+	parent := e.parent
+	if parent == nil {
+		return errPerm
 	}
+	if len(e.children) > 0 && !recursive {
+		return errEmpty
+	}
+	delete(parent.children, e.ref.Name)
+	parent.modified("")
+	ns.drop(e)
+	return nil
 }
 
-// Walk to child entry with name "next".
-func (ns *Namespace) Walk(cur *ninep.Qid, next string) *ninep.Qid {
-	e := ns.dict[cur.Path]
+// drop an entry and its subtree from the dictionary.
+func (ns *Namespace) drop(e *Entry) {
 	for _, c := range e.children {
-		if c.ref.Name == next {
-			return &c.ref.Qid
-		}
+		ns.drop(c)
 	}
-	return nil
+	delete(ns.dict, e.ref.Path)
+	ns.unmount(e)
 }
 
-// Open entry for file operation
-func (ns *Namespace) Open(t *ninep.Topen, q *ninep.Qid) {
-	t.Respond(q, 8192)
+// BackupFunc is called for entries of a namespace during a backup with the
+// path, stat and content (nil for directories) of an entry.
+type BackupFunc func(path string, d ninep.Dir, data []byte) error
+
+// Backup hands all entries of the namespace to fcn (directories before
+// their content, sorted by name). Temporary entries (DMTMP) including
+// their content are skipped, as are the content of dynamic directories
+// and bound namespaces.
+func (ns *Namespace) Backup(fcn BackupFunc) error {
+	ns.mtx.RLock()
+	root := ns.dict[0]
+	ns.mtx.RUnlock()
+	return ns.backup("/", root, fcn)
 }
 
-// Read from entry. Either return the content of a file
-// or the listing from a directory.
-func (ns *Namespace) Read(t *ninep.Tread, q *ninep.Qid) {
-	e, ok := ns.dict[q.Path]
-	if !ok {
-		t.Err(errNoFile)
-		return
-	}
-	if e.children != nil {
-		var kids []ninep.Dir
+// backup an entry and its content.
+func (ns *Namespace) backup(path string, e *Entry, fcn BackupFunc) (err error) {
+	ns.mtx.RLock()
+	d := *e.ref
+	var kids []*Entry
+	if e.list == nil {
 		for _, c := range e.children {
-			kids = append(kids, *c.ref)
+			kids = append(kids, c)
+		}
+		slices.SortFunc(kids, func(a, b *Entry) int {
+			return strings.Compare(a.ref.Name, b.ref.Name)
+		})
+	}
+	ns.mtx.RUnlock()
+	if d.Mode&ninep.DMTmp != 0 {
+		return nil
+	}
+	var data []byte
+	if !e.IsDir() {
+		if data, err = e.file.Read(); err != nil {
+			return
 		}
-		ninep.ReadDir(t, kids)
+		d.Len = uint64(len(data))
+	}
+	if err = fcn(path, d, data); err != nil {
 		return
 	}
-	data, err := e.file.Read()
-	if err != nil {
-		t.Err(err)
-	} else {
-		ninep.ReadBuf(t, data)
+	for _, c := range kids {
+		ns.mtx.RLock()
+		name := c.ref.Name
+		ns.mtx.RUnlock()
+		if err = ns.backup(gopath.Join(path, name), c, fcn); err != nil {
+			return
+		}
 	}
+	return nil
 }
 
-// Stat returns information for a filesytem entry.
-func (ns *Namespace) Stat(t *ninep.Tstat, q *ninep.Qid) {
-	e, ok := ns.dict[q.Path]
-	if !ok {
-		t.Err(errNoFile)
-	} else {
-		t.Respond(e.ref)
+// split a path into (normalized) directory and name of the last element.
+func split(path string) (dir, name string) {
+	path = gopath.Clean(path)
+	idx := strings.LastIndex(path, "/")
+	return path[:max(1, idx)], path[idx+1:]
+}
+
+// validName checks if a name is valid for a new entry.
+func validName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Serve the 9p protocol for the given listen string (see Server for
+// serving on other listeners and for shutting down).
+func (ns *Namespace) Serve(listen string) error {
+	lst, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
 	}
+	return NewServer(ns, lst, nil).Serve()
 }
@@ -21,9 +21,17 @@
 package srv9p
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"git.sr.ht/~moody/ninep"
 )
 
 // build a test namespace
@@ -47,3 +55,1296 @@ func newNamespace() (ns *Namespace, err error) {
 func TestNamespaceNew(t *testing.T) {
 	newNamespace()
 }
+
+// bufFile is a simple in-memory file for testing.
+type bufFile struct {
+	data []byte
+}
+
+func (f *bufFile) Read() ([]byte, error) {
+	return f.data, nil
+}
+
+func (f *bufFile) Write(data []byte) error {
+	f.data = append([]byte(nil), data...)
+	return nil
+}
+
+func TestNamespaceWrite(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bufFile)
+	if err = ns.NewFile("/sensors/ctl", 0666, buf); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+
+	// write in two chunks
+	if _, err = c.walk(0, 1, "sensors", "ctl"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(1, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []uint64{0, 5} {
+		n, err := c.write(1, off, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 5 {
+			t.Fatalf("write count %d != 5", n)
+		}
+	}
+	if string(buf.data) != "hellohello" {
+		t.Fatalf("content mismatch: '%s'", buf.data)
+	}
+	// partial overwrite keeps the rest of the content
+	if _, err = c.write(1, 3, []byte("LO")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.write(1, 0, []byte("HE")); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf.data) != "HElLOhello" {
+		t.Fatalf("content mismatch: '%s'", buf.data)
+	}
+	// writing beyond the end pads with zeros
+	if _, err = c.write(1, 12, []byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf.data) != "HElLOhello\x00\x00!" {
+		t.Fatalf("content mismatch: %q", buf.data)
+	}
+	// read-only file
+	if _, err = c.walk(0, 2, "readme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(2, OWRITE); err == nil || err.Error() != errPerm.Error() {
+		t.Fatalf("open read-only file: %v", err)
+	}
+	// fid not opened
+	if _, err = c.write(2, 0, []byte("test")); err == nil || err.Error() != errNotOpen.Error() {
+		t.Fatalf("write to unopened fid: %v", err)
+	}
+	if _, err = c.read(2, 0, 64); err == nil || err.Error() != errNotOpen.Error() {
+		t.Fatalf("read from unopened fid: %v", err)
+	}
+	// directory
+	if _, err = c.walk(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(3, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.write(3, 0, []byte("test")); err == nil || err.Error() != errIsDir.Error() {
+		t.Fatalf("write to directory: %v", err)
+	}
+}
+
+// genReader generates content on the fly
+type genReader struct {
+	reads int
+}
+
+func (r *genReader) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	for i := range p {
+		p[i] = byte(off + int64(i))
+	}
+	return len(p), nil
+}
+
+func TestNamespaceStream(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := new(genReader)
+	size := int64(65536)
+	if err = ns.NewFile("/blob", 0444, NewStreamFile(gen, size)); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "blob"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.stat(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len != uint64(size) {
+		t.Fatalf("size mismatch: %d != %d", d.Len, size)
+	}
+	if _, _, err = c.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.readAll(1, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != size {
+		t.Fatalf("read %d bytes", len(data))
+	}
+	for i, b := range data {
+		if b != byte(i) {
+			t.Fatalf("content mismatch at %d", i)
+		}
+	}
+	if gen.reads != 8 {
+		t.Fatalf("%d reads", gen.reads)
+	}
+}
+
+func TestNamespaceSnapshot(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err = ns.NewFile("/sensors/count", 0444, NewFuncFile(
+		func() ([]byte, error) {
+			count++
+			return []byte(fmt.Sprintf("reading %08d\n", count)), nil
+		},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+	for _, fid := range []uint32{1, 2} {
+		if _, err = c.walk(0, fid, "sensors", "count"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = c.open(fid, OREAD); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// interleaved reads in small chunks must return one reading per fid
+	var data [2][]byte
+	for off := uint64(0); off < 32; off += 3 {
+		for i := range 2 {
+			buf, err := c.read(uint32(i+1), off, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[i] = append(data[i], buf...)
+		}
+	}
+	for i, exp := range []string{"reading 00000001\n", "reading 00000002\n"} {
+		if string(data[i]) != exp {
+			t.Fatalf("fid %d: '%s' != '%s'", i+1, data[i], exp)
+		}
+	}
+	for _, fid := range []uint32{1, 2} {
+		if err = c.clunk(fid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ns.open) != 0 {
+		t.Fatalf("%d handles not released", len(ns.open))
+	}
+}
+
+// ctlFile accepts only one open at a time and commits written
+// data on close.
+type ctlFile struct {
+	bufFile
+	busy   bool
+	commit string
+}
+
+func (f *ctlFile) Open(mode byte) error {
+	if f.busy {
+		return errors.New("device busy")
+	}
+	f.busy = true
+	return nil
+}
+
+func (f *ctlFile) Close() error {
+	f.busy = false
+	f.commit = string(f.data)
+	return nil
+}
+
+func TestNamespaceOpenClose(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := new(ctlFile)
+	if err = ns.NewFile("/sensors/ctl", 0666, ctl); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+	for _, fid := range []uint32{1, 2} {
+		if _, err = c.walk(0, fid, "sensors", "ctl"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err = c.open(1, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(2, OWRITE); err == nil {
+		t.Fatal("second open succeeded")
+	}
+	if _, err = c.write(1, 0, []byte("start")); err != nil {
+		t.Fatal(err)
+	}
+	if ctl.commit != "" {
+		t.Fatal("committed before close")
+	}
+	if err = c.clunk(1); err != nil {
+		t.Fatal(err)
+	}
+	if ctl.commit != "start" {
+		t.Fatalf("commit mismatch: '%s'", ctl.commit)
+	}
+	if _, _, err = c.open(2, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	// opened fids can't be cloned
+	if _, err = c.walk(2, 3); err == nil || err.Error() != errOpen.Error() {
+		t.Fatalf("clone of opened fid: %v", err)
+	}
+	if _, err = c.read(2, 0, 64); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sessionFile is a per-open file that can reject the open.
+type sessionFile struct {
+	NopFile
+	fail   bool
+	closed *int
+}
+
+func (f *sessionFile) Open(mode byte) error {
+	if f.fail {
+		return errors.New("device busy")
+	}
+	return nil
+}
+
+func (f *sessionFile) Close() error {
+	*f.closed++
+	return nil
+}
+
+// sessionHandler creates per-open files.
+type sessionHandler struct {
+	NopFile
+	fail   bool
+	closed int
+}
+
+func (f *sessionHandler) Handle() (File, error) {
+	return &sessionFile{fail: f.fail, closed: &f.closed}, nil
+}
+
+func TestNamespaceOpenFail(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdlr := &sessionHandler{fail: true}
+	if err = ns.NewFile("/dev", 0666, hdlr); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	// per-open file is closed if the open is rejected
+	if _, _, err = c.open(1, ORDWR); err == nil {
+		t.Fatal("open succeeded")
+	}
+	if hdlr.closed != 1 {
+		t.Fatalf("%d closes", hdlr.closed)
+	}
+	hdlr.fail = false
+	if _, _, err = c.open(1, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.clunk(1); err != nil {
+		t.Fatal(err)
+	}
+	if hdlr.closed != 2 {
+		t.Fatalf("%d closes", hdlr.closed)
+	}
+}
+
+func TestNamespaceCreate(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewDir("/tmp", 0777); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ns.Get("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tmp.SetCreator(func(name string, perm uint32) (File, error) {
+		if name == "forbidden" {
+			return nil, errPerm
+		}
+		return NewMemFile(nil), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+
+	// create file in directory without creator
+	if _, err = c.walk(0, 1, "sensors"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.create(1, "new", 0666, OWRITE); err == nil {
+		t.Fatal("create in /sensors succeeded")
+	}
+	// create directory and file in /tmp
+	if _, err = c.walk(0, 2, "tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.create(2, "forbidden", 0666, OWRITE); err == nil {
+		t.Fatal("rejected create succeeded")
+	}
+	qid, err := c.create(2, "sub", ninep.DMDir|0755, OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qid.Type&ninep.QTDir == 0 {
+		t.Fatal("created entry is not a directory")
+	}
+	if _, err = c.walk(0, 3, "tmp", "sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.create(3, "scratch", 0644, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.create(3, "scratch", 0644, ORDWR); err == nil {
+		t.Fatal("duplicate create succeeded")
+	}
+	if _, err = c.write(3, 0, []byte("scratch data")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.readAll(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "scratch data" {
+		t.Fatalf("content mismatch: '%s'", data)
+	}
+	e, err := ns.Get("/tmp/sub/scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ref.Mode != 0644 {
+		t.Fatalf("mode mismatch: %o", e.ref.Mode)
+	}
+}
+
+func TestNamespaceRemove(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/sensors/i2c", "/sensors/i2c/0x48"} {
+		if err = ns.NewDir(path, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ns.NewFile("/sensors/i2c/0x48/temp", 0444, new(NopFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/sensors/fixed", 0444, new(NopFile)); err != nil {
+		t.Fatal(err)
+	}
+	fixed, _ := ns.Get("/sensors/fixed")
+	fixed.SetRemover(func() error {
+		return errPerm
+	})
+	size := len(ns.dict)
+
+	// remove via 9p
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "readme"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.remove(1); err == nil {
+		t.Fatal("removed file from read-only directory")
+	}
+	if _, err = c.walk(0, 2, "sensors", "i2c"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.remove(2); err == nil {
+		t.Fatal("removed non-empty directory")
+	}
+	if _, err = c.walk(0, 3, "sensors", "fixed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.remove(3); err == nil {
+		t.Fatal("removal not rejected")
+	}
+	if _, err = c.walk(0, 4, "sensors", "temp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(4, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.remove(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(0, 5, "sensors", "temp"); err == nil {
+		t.Fatal("removed file still exists")
+	}
+	if len(ns.open) != 0 || len(ns.dict) != size-1 {
+		t.Fatal("removed file not released")
+	}
+
+	// remove via Go API
+	if err = ns.Remove("/sensors/i2c", false); err == nil {
+		t.Fatal("removed non-empty directory")
+	}
+	if err = ns.Remove("/sensors/i2c", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ns.dict) != size-4 {
+		t.Fatalf("subtree not released: %d entries", len(ns.dict))
+	}
+	if err = ns.Remove("/", true); err == nil {
+		t.Fatal("removed root")
+	}
+}
+
+func TestNamespaceWstat(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/sensors/log", 0644, NewMemFile([]byte("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/sensors/fixed", 0644, new(NopFile)); err != nil {
+		t.Fatal(err)
+	}
+	fixed, _ := ns.Get("/sensors/fixed")
+	fixed.SetWstat(func(d *ninep.Dir) error {
+		if len(d.Name) > 0 {
+			return errPerm
+		}
+		return nil
+	})
+	c := newTestClient(t, ns, "sys")
+	if _, err = c.walk(0, 1, "sensors", "log"); err != nil {
+		t.Fatal(err)
+	}
+	// don't touch anything
+	if err = c.wstat(1, dontTouch()); err != nil {
+		t.Fatal(err)
+	}
+	// growth is limited
+	d := dontTouch()
+	d.Len = 1 << 62
+	if err = c.wstat(1, d); err == nil || err.Error() != errGrowth.Error() {
+		t.Fatalf("huge length: %v", err)
+	}
+	// rename, chmod, chown and truncate
+	d = dontTouch()
+	d.Name = "log.old"
+	d.Mode = 0600
+	d.Uid = "glenda"
+	d.Len = 4
+	if err = c.wstat(1, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ns.Get("/sensors/log"); err == nil {
+		t.Fatal("old name still exists")
+	}
+	e, err := ns.Get("/sensors/log.old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ref.Mode != 0600 || e.ref.Uid != "glenda" || e.ref.Gid != "sys" {
+		t.Fatalf("stat mismatch: %v", e.ref)
+	}
+	if st, err := c.stat(1); err != nil || st.Len != 4 || st.Name != "log.old" {
+		t.Fatalf("stat mismatch: %v (%v)", st, err)
+	}
+	// invalid changes
+	d = dontTouch()
+	d.Name = "temp"
+	if err = c.wstat(1, d); err == nil {
+		t.Fatal("renamed to existing name")
+	}
+	d = dontTouch()
+	d.Mode = ninep.DMDir | 0755
+	if err = c.wstat(1, d); err == nil {
+		t.Fatal("changed file to directory")
+	}
+	if _, err = c.walk(0, 2, "sensors", "fixed"); err != nil {
+		t.Fatal(err)
+	}
+	d = dontTouch()
+	d.Name = "moved"
+	d.Mode = 0600
+	if err = c.wstat(2, d); err == nil {
+		t.Fatal("veto ignored")
+	}
+	if fixed.ref.Mode != 0644 {
+		t.Fatal("rejected changes partially applied")
+	}
+}
+
+func TestNamespacePerm(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := NewMemFile([]byte("off"))
+	if err = ns.NewFile("/relay", 0664, relay); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewDir("/private", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/private/key", 0600, NewTextFile("secret")); err != nil {
+		t.Fatal(err)
+	}
+	ns.SetGroups(func(user, group string) bool {
+		return user == group || (user == "glenda" && group == "sys")
+	})
+	tests := []struct {
+		user  string
+		path  []string
+		mode  byte
+		allow bool
+	}{
+		{"none", []string{"relay"}, OREAD, true},
+		{"none", []string{"relay"}, OWRITE, false},
+		{"none", []string{"relay"}, OREAD | OTRUNC, false},
+		{"glenda", []string{"relay"}, ORDWR, true},
+		{"sys", []string{"relay"}, OWRITE | OTRUNC, true},
+		{"none", []string{"private", "key"}, OREAD, false},
+		{"glenda", []string{"private", "key"}, OREAD, false},
+		{"sys", []string{"private", "key"}, OREAD, true},
+		{"sys", []string{"private"}, OWRITE, false},
+		{"none", []string{"readme"}, OREAD | ORCLOSE, false},
+	}
+	for i, tc := range tests {
+		c := newTestClient(t, ns, tc.user)
+		_, err := c.walk(0, 1, tc.path...)
+		if err == nil {
+			_, _, err = c.open(1, tc.mode)
+		}
+		if (err == nil) != tc.allow {
+			t.Fatalf("test %d: %s open %v mode %d: %v", i, tc.user, tc.path, tc.mode, err)
+		}
+	}
+	if len(relay.data) != 0 {
+		t.Fatal("file not truncated")
+	}
+	// write to file opened for reading
+	c := newTestClient(t, ns, "sys")
+	if _, err = c.walk(0, 1, "relay"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.write(1, 0, []byte("on")); err == nil {
+		t.Fatal("write to fid opened for reading")
+	}
+}
+
+func TestNamespaceConcurrent(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewDir("/tmp", 0777); err != nil {
+		t.Fatal(err)
+	}
+	tmp, _ := ns.Get("/tmp")
+	tmp.SetCreator(func(name string, perm uint32) (File, error) {
+		return NewMemFile(nil), nil
+	})
+	const (
+		numClients = 16
+		numRounds  = 50
+	)
+	errs := make(chan error, numClients+1)
+	var wg sync.WaitGroup
+
+	// modify the namespace from Go code while clients are active
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range numClients * numRounds {
+			path := fmt.Sprintf("/sensors/s%d", i%8)
+			if err := ns.NewFile(path, 0444, NewTextFile(path)); err != nil {
+				errs <- err
+				return
+			}
+			if err := ns.Remove(path, false); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	// hammer the namespace from many clients
+	for n := range numClients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := newTestClient(t, ns, "glenda")
+			run := func(i int) error {
+				name := fmt.Sprintf("c%d-%d", n, i)
+				data := []byte(name)
+				if _, err := c.walk(0, 1, "tmp"); err != nil {
+					return err
+				}
+				if _, err := c.create(1, name, 0666, ORDWR); err != nil {
+					return err
+				}
+				if _, err := c.write(1, 0, data); err != nil {
+					return err
+				}
+				if buf, err := c.read(1, 0, 64); err != nil {
+					return err
+				} else if string(buf) != name {
+					return fmt.Errorf("read %q, expected %q", buf, name)
+				}
+				if _, err := c.stat(1); err != nil {
+					return err
+				}
+				if err := c.remove(1); err != nil {
+					return err
+				}
+				// list directories changed by other clients
+				for _, dir := range []string{"tmp", "sensors"} {
+					if _, err := c.walk(0, 2, dir); err != nil {
+						return err
+					}
+					if _, _, err := c.open(2, OREAD); err != nil {
+						return err
+					}
+					if _, err := c.list(2, 8192); err != nil {
+						return err
+					}
+					if err := c.clunk(2); err != nil {
+						return err
+					}
+				}
+				// entries removed concurrently may be missing
+				if _, err := c.walk(0, 3, "sensors", fmt.Sprintf("s%d", i%8)); err == nil {
+					c.stat(3)
+					c.clunk(3)
+				}
+				return nil
+			}
+			for i := range numRounds {
+				if err := run(i); err != nil {
+					errs <- fmt.Errorf("client %d round %d: %w", n, i, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if kids := len(tmp.children); kids != 0 {
+		t.Fatalf("%d entries left in /tmp", kids)
+	}
+}
+
+func TestNamespaceStat(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/log", 0666, &bufFile{}); err != nil {
+		t.Fatal(err)
+	}
+	log, _ := ns.Get("/log")
+	if log.ref.Mtime == 0 || log.ref.Atime == 0 {
+		t.Fatal("times not set")
+	}
+	log.ref.Mtime, log.ref.Atime = 0, 0
+
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "log"); err != nil {
+		t.Fatal(err)
+	}
+	qid, _, err := c.open(1, ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write changes length, version, mtime and muid
+	for i := range 3 {
+		if _, err = c.write(1, uint64(4*i), []byte("line")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := c.stat(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len != 12 || d.Vers != qid.Vers+3 || d.Mtime == 0 || d.Muid != "glenda" {
+		t.Fatalf("stat after write: %+v", d)
+	}
+	// read changes access time only
+	if _, err = c.read(1, 0, 64); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = c.stat(1); err != nil {
+		t.Fatal(err)
+	}
+	if d.Atime == 0 || d.Vers != qid.Vers+3 {
+		t.Fatalf("stat after read: %+v", d)
+	}
+	// content changed from Go code
+	log.Modified()
+	if d, err = c.stat(1); err != nil {
+		t.Fatal(err)
+	}
+	if d.Vers != qid.Vers+4 {
+		t.Fatalf("stat after change: %+v", d)
+	}
+	// volatile file gets a new version on every stat
+	if _, err = c.walk(0, 2, "sensors", "temp"); err != nil {
+		t.Fatal(err)
+	}
+	d1, err := c.stat(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := c.stat(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.Vers == d2.Vers || d2.Len != 0 {
+		t.Fatalf("volatile file: %+v, %+v", d1, d2)
+	}
+	// directory version changes with its entries
+	if d1, err = c.stat(0); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.Remove("/log", false); err != nil {
+		t.Fatal(err)
+	}
+	if d2, err = c.stat(0); err != nil {
+		t.Fatal(err)
+	}
+	if d2.Vers == d1.Vers {
+		t.Fatal("directory version unchanged")
+	}
+}
+
+func TestNamespaceWalk(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewDir("/sensors/./i2c/", 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/sensors/i2c/../..", 0444, &NopFile{}); err == nil {
+		t.Fatal("invalid name accepted")
+	}
+	root, _ := ns.Get("/")
+	temp, _ := ns.Get("/sensors/temp")
+	i2c, _ := ns.Get("/sensors/i2c")
+
+	// path normalization
+	for path, want := range map[string]*Entry{
+		"/..":                              root,
+		"/sensors/..":                      root,
+		"//sensors//temp":                  temp,
+		"/sensors/./temp":                  temp,
+		"/sensors/i2c/../temp":             temp,
+		"/../sensors/i2c/../../..":         root,
+		"/sensors/i2c/./../../sensors/i2c": i2c,
+	} {
+		if e, err := ns.Get(path); err != nil || e != want {
+			t.Fatalf("get %s: %v", path, err)
+		}
+	}
+	if _, err = ns.Get("/sensors/temp/.."); err == nil {
+		t.Fatal("walked up from file")
+	}
+
+	// multi-element walks
+	c := newTestClient(t, ns, "glenda")
+	tests := []struct {
+		names []string
+		want  *Entry
+	}{
+		{[]string{".."}, root},
+		{[]string{"sensors", ".."}, root},
+		{[]string{"sensors", "i2c", "..", "temp"}, temp},
+		{[]string{"sensors", "i2c", "..", "..", "..", "sensors", "i2c"}, i2c},
+		{[]string{"sensors", "temp", ".."}, nil},
+		{[]string{"sensors", "missing", ".."}, nil},
+	}
+	for i, tc := range tests {
+		qids, err := c.walk(0, 1, tc.names...)
+		if tc.want == nil {
+			if err == nil {
+				t.Fatalf("test %d: walk %v succeeded", i, tc.names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: walk %v: %v", i, tc.names, err)
+		}
+		if len(qids) != len(tc.names) || qids[len(qids)-1].Path != tc.want.ref.Path {
+			t.Fatalf("test %d: walk %v: %v", i, tc.names, qids)
+		}
+		if err = c.clunk(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNamespaceList(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"temp"}
+	for _, i := range rand.Perm(200) {
+		name := fmt.Sprintf("s%03d", i)
+		if err = ns.NewFile("/sensors/"+name, 0444, NewTextFile(name)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	slices.Sort(want)
+
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "sensors"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	// changes after open are not visible in the listing
+	if err = ns.Remove("/sensors/s100", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/sensors/new", 0444, &NopFile{}); err != nil {
+		t.Fatal(err)
+	}
+	// paged reads (smaller than iounit)
+	for _, chunk := range []uint32{8192, 512, 100} {
+		names, err := c.list(1, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(names, want) {
+			t.Fatalf("chunk %d: listing %v", chunk, names)
+		}
+	}
+	// reads must start at an entry and return complete entries
+	if _, err = c.read(1, 10, 8192); err == nil {
+		t.Fatal("read at bad offset")
+	}
+	if _, err = c.read(1, 0, 40); err == nil {
+		t.Fatal("short read")
+	}
+	// new open sees changes
+	if _, err = c.walk(0, 2, "sensors"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.open(2, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	names, err := c.list(2, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(want) || slices.Contains(names, "s100") || !slices.Contains(names, "new") {
+		t.Fatalf("listing after change: %v", names)
+	}
+}
+
+func TestNamespaceWalkFile(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, _ := ns.Get("/sensors/temp")
+	for _, name := range []string{"x", "..", "."} {
+		if ns.walk(temp, name) != nil || ns.walk(nil, name) != nil {
+			t.Fatalf("walk %q from file", name)
+		}
+	}
+	c := newTestClient(t, ns, "glenda")
+	if _, err = c.walk(0, 1, "readme", "x"); err == nil {
+		t.Fatal("walked from file")
+	}
+	if _, err = c.walk(0, 1, "readme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(1, 2, "x"); err == nil {
+		t.Fatal("walked from file")
+	}
+}
+
+// build a tree with given depth and width: each directory on the path
+// "/d/d/.../d" contains width files.
+func benchTree(b *testing.B, depth, width int) (ns *Namespace, path string) {
+	b.Helper()
+	ns = NewNamespace("sys", "sys")
+	for range depth {
+		path += "/d"
+		if err := ns.NewDir(path, 0555); err != nil {
+			b.Fatal(err)
+		}
+		for i := range width {
+			if err := ns.NewFile(fmt.Sprintf("%s/f%d", path, i), 0444, &NopFile{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return ns, path
+}
+
+func BenchmarkNamespaceGetDeep(b *testing.B) {
+	ns, path := benchTree(b, 64, 1)
+	path += "/f0"
+	for b.Loop() {
+		if _, err := ns.Get(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNamespaceGetWide(b *testing.B) {
+	ns, _ := benchTree(b, 1, 1000)
+	for i := 0; b.Loop(); i++ {
+		if _, err := ns.Get(fmt.Sprintf("/d/f%d", i%1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionWalkDeep(b *testing.B) {
+	ns, path := benchTree(b, 16, 1)
+	names := append(strings.Split(path[1:], "/"), "f0")
+	c := newTestClient(b, ns, "none")
+	for b.Loop() {
+		if _, err := c.walk(0, 1, names...); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.clunk(1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionWalkWide(b *testing.B) {
+	ns, _ := benchTree(b, 1, 1000)
+	c := newTestClient(b, ns, "none")
+	for i := 0; b.Loop(); i++ {
+		if _, err := c.walk(0, 1, "d", fmt.Sprintf("f%d", i%1000)); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.clunk(1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNamespaceEvents(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := NewEventFile(4)
+	if err = ns.NewFile("/events", 0444, events); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+	for fid := uint32(1); fid <= 2; fid++ {
+		if _, err = c.walk(0, fid, "events"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = c.open(fid, OREAD); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readReq := func(fid uint32) uint16 {
+		var b msgBuf
+		return c.send(msgTread, b.u32(fid).u64(0).u32(64))
+	}
+	// blocking read doesn't block other requests
+	tag := readReq(1)
+	if _, err = c.stat(0); err != nil {
+		t.Fatal(err)
+	}
+	events.Post([]byte("button 1"))
+	typ, rtag, body, err := c.recv()
+	if err != nil || typ != msgTread+1 || rtag != tag || string(body[4:]) != "button 1" {
+		t.Fatalf("read event: %d %d %q %v", typ, rtag, body, err)
+	}
+	// all fids receive events
+	if data, err := c.read(2, 0, 64); err != nil || string(data) != "button 1" {
+		t.Fatalf("read event: %q %v", data, err)
+	}
+	// flushed read is not answered
+	tag = readReq(1)
+	if _, err = c.stat(0); err != nil {
+		t.Fatal(err)
+	}
+	var b msgBuf
+	ftag := c.send(msgTflush, b.u16(tag))
+	if typ, rtag, _, err = c.recv(); err != nil || typ != msgTflush+1 || rtag != ftag {
+		t.Fatalf("flush: %d %d %v", typ, rtag, err)
+	}
+	events.Post([]byte("button 2"))
+	for fid := uint32(1); fid <= 2; fid++ {
+		if data, err := c.read(fid, 0, 64); err != nil || string(data) != "button 2" {
+			t.Fatalf("read after flush: %q %v", data, err)
+		}
+	}
+	// clunk interrupts pending read
+	tag = readReq(2)
+	if _, err = c.stat(0); err != nil {
+		t.Fatal(err)
+	}
+	b = nil
+	ctag := c.send(msgTclunk, b.u32(2))
+	for range 2 {
+		typ, rtag, _, err = c.recv()
+		switch rtag {
+		case tag:
+			if typ != msgRerror || err.Error() != errIntr.Error() {
+				t.Fatalf("interrupted read: %d %v", typ, err)
+			}
+		case ctag:
+			if err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatalf("unexpected response %d", rtag)
+		}
+	}
+	if len(events.subs) != 1 {
+		t.Fatalf("%d event queues left", len(events.subs))
+	}
+}
+
+func TestNamespaceModes(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := []File{NewMemFile(nil), &bufFile{}}
+	for i, f := range logs {
+		if err = ns.NewFile(fmt.Sprintf("/log%d", i), ninep.DMAppend|0666, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ns.NewFile("/motor", ninep.DMExcl|0666, NewMemFile(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewDir("/scratch", ninep.DMTmp|0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/scratch/data", 0666, NewMemFile(nil)); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, ns, "glenda")
+
+	// append-only files
+	for i, f := range logs {
+		qids, err := c.walk(0, 1, fmt.Sprintf("log%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qids[0].Type != ninep.QTAppend {
+			t.Fatalf("qid type %x", qids[0].Type)
+		}
+		if _, _, err = c.open(1, ORDWR); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"one\n", "two\n"} {
+			if _, err = c.write(1, 0, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if data, _ := f.Read(); string(data) != "one\ntwo\n" {
+			t.Fatalf("log %d: %q", i, data)
+		}
+		if err = c.clunk(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// exclusive-use file
+	qids, err := c.walk(0, 1, "motor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qids[0].Type != ninep.QTExcl {
+		t.Fatalf("qid type %x", qids[0].Type)
+	}
+	if _, _, err = c.open(1, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestClient(t, ns, "glenda")
+	if _, err = other.walk(0, 1, "motor"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = other.open(1, OREAD); err == nil {
+		t.Fatal("exclusive file opened twice")
+	}
+	if err = c.clunk(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = other.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	// mode changes are reflected in the qid type
+	c2 := newTestClient(t, ns, "sys")
+	if _, err = c2.walk(0, 1, "readme"); err != nil {
+		t.Fatal(err)
+	}
+	d := dontTouch()
+	d.Mode = ninep.DMAppend | 0644
+	if err = c2.wstat(1, d); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = c2.stat(1); err != nil || d.Type != ninep.QTAppend {
+		t.Fatalf("stat after chmod: %+v, %v", d, err)
+	}
+	// temporary entries are not backed up
+	var paths []string
+	err = ns.Backup(func(path string, d ninep.Dir, data []byte) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/log0", "/log1", "/motor", "/readme", "/sensors", "/sensors/temp"}
+	if !slices.Equal(paths, want) {
+		t.Fatalf("backup: %v", paths)
+	}
+}
+
+// relayFile records the clients switching a relay.
+type relayFile struct {
+	NopFile
+	log []Client
+}
+
+func (f *relayFile) ReadContext(ctx context.Context) ([]byte, error) {
+	c, ok := ClientFrom(ctx)
+	if !ok {
+		return nil, errPerm
+	}
+	return []byte("hello " + c.User), nil
+}
+
+func (f *relayFile) WriteContext(ctx context.Context, data []byte) error {
+	c, _ := ClientFrom(ctx)
+	f.log = append(f.log, *c)
+	return nil
+}
+
+func TestNamespaceClient(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := new(relayFile)
+	if err = ns.NewFile("/relay", 0666, relay); err != nil {
+		t.Fatal(err)
+	}
+	var conns []uint64
+	for _, user := range []string{"glenda", "bootes"} {
+		c := newTestConn(t, ns)
+		var b msgBuf
+		if _, _, err = c.rpc(msgTattach, b.u32(0).u32(nofid).str(user).str("relays")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.walk(0, 7, "relay"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = c.open(7, ORDWR); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := c.read(7, 0, 100); err != nil || string(data) != "hello "+user {
+			t.Fatalf("read: %q, %v", data, err)
+		}
+		if _, err = c.write(7, 0, []byte("on")); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, relay.log[len(relay.log)-1].Conn)
+	}
+	if len(relay.log) != 2 || conns[0] == conns[1] {
+		t.Fatalf("log: %+v", relay.log)
+	}
+	for i, user := range []string{"glenda", "bootes"} {
+		if c := relay.log[i]; c.User != user || c.Aname != "relays" || c.Fid != 7 {
+			t.Fatalf("client %d: %+v", i, c)
+		}
+	}
+}
+
+func TestNamespaceDisconnect(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/sensors/ctl", 0666, new(ctlFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/motor", ninep.DMExcl|0666, NewMemFile(nil)); err != nil {
+		t.Fatal(err)
+	}
+	c1 := newTestClient(t, ns, "glenda")
+	if _, err = c1.walk(0, 1, "sensors", "ctl"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c1.open(1, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c1.walk(0, 2, "motor"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c1.open(2, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+	// files are closed when the connection drops
+	c1.conn.Close()
+	c2 := newTestClient(t, ns, "glenda")
+	for i, path := range [][]string{{"sensors", "ctl"}, {"motor"}} {
+		fid := uint32(i + 1)
+		if _, err = c2.walk(0, fid, path...); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			if _, _, err = c2.open(fid, ORDWR); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("open %v: %v", path, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	ns.hmtx.Lock()
+	defer ns.hmtx.Unlock()
+	if len(ns.open) != 2 {
+		t.Fatalf("%d handles", len(ns.open))
+	}
+}
@@ -0,0 +1,388 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Plan 9 authentication (4th edition) constants
+const (
+	anameLen   = 28 // length of user/auth names
+	domLen     = 48 // length of authentication domain
+	desKeyLen  = 7  // length of DES key
+	chalLen    = 8  // length of challenge
+	ticketLen  = 1 + chalLen + 2*anameLen + desKeyLen
+	authentLen = 1 + chalLen + 4
+	tickReqLen = 1 + 3*anameLen + domLen + chalLen
+)
+
+// Plan 9 authentication message types
+const (
+	authTreq = 1  // ticket request
+	authOK   = 4  // ticket request accepted
+	authErr  = 5  // ticket request rejected
+	authTs   = 64 // ticket encrypted with server's key
+	authTc   = 65 // ticket encrypted with client's key
+	authAs   = 66 // server generated authenticator
+	authAc   = 67 // client generated authenticator
+)
+
+// Error messages
+var (
+	errKey = errors.New("invalid DES key")
+)
+
+// ticket is a Plan 9 authentication ticket issued by an auth server.
+type ticket struct {
+	Num  byte          // ticket type (authTs or authTc)
+	Chal [chalLen]byte // server challenge
+	CUid string        // client user
+	SUid string        // user on server
+	Key  []byte        // session key (desKeyLen)
+}
+
+// Bytes returns the ticket encrypted with the given key.
+func (t *ticket) Bytes(key []byte) []byte {
+	b := make([]byte, 0, ticketLen)
+	b = append(b, t.Num)
+	b = append(b, t.Chal[:]...)
+	b = putName(b, t.CUid, anameLen)
+	b = putName(b, t.SUid, anameLen)
+	b = append(b, t.Key[:desKeyLen]...)
+	encrypt(key, b)
+	return b
+}
+
+// parseTicket decrypts a ticket with the given key.
+func parseTicket(b, key []byte) (*ticket, error) {
+	if len(b) != ticketLen {
+		return nil, errMsg
+	}
+	b = append([]byte(nil), b...)
+	if err := decrypt(key, b); err != nil {
+		return nil, err
+	}
+	t := &ticket{Num: b[0]}
+	copy(t.Chal[:], b[1:])
+	b = b[1+chalLen:]
+	t.CUid, b = getName(b, anameLen)
+	t.SUid, b = getName(b, anameLen)
+	t.Key = b[:desKeyLen]
+	return t, nil
+}
+
+// ticketReq is a request for tickets sent to an auth server.
+type ticketReq struct {
+	Type    byte          // request type (authTreq)
+	AuthID  string        // server user
+	AuthDom string        // authentication domain
+	Chal    [chalLen]byte // server challenge
+	HostID  string        // client user
+	UID     string        // user on server
+}
+
+// Bytes returns the encoded ticket request.
+func (r *ticketReq) Bytes() []byte {
+	b := make([]byte, 0, tickReqLen)
+	b = append(b, r.Type)
+	b = putName(b, r.AuthID, anameLen)
+	b = putName(b, r.AuthDom, domLen)
+	b = append(b, r.Chal[:]...)
+	b = putName(b, r.HostID, anameLen)
+	return putName(b, r.UID, anameLen)
+}
+
+// parseTicketReq decodes a ticket request.
+func parseTicketReq(b []byte) (*ticketReq, error) {
+	if len(b) != tickReqLen {
+		return nil, errMsg
+	}
+	r := &ticketReq{Type: b[0]}
+	r.AuthID, b = getName(b[1:], anameLen)
+	r.AuthDom, b = getName(b, domLen)
+	copy(r.Chal[:], b)
+	r.HostID, b = getName(b[chalLen:], anameLen)
+	r.UID, _ = getName(b, anameLen)
+	return r, nil
+}
+
+// authenticator proves the possession of a session key.
+type authenticator struct {
+	Num  byte          // authenticator type (authAc or authAs)
+	Chal [chalLen]byte // challenge of the peer
+	ID   uint32        // authenticator id
+}
+
+// Bytes returns the authenticator encrypted with the given key.
+func (a *authenticator) Bytes(key []byte) []byte {
+	b := make([]byte, 0, authentLen)
+	b = append(b, a.Num)
+	b = append(b, a.Chal[:]...)
+	b = binary.LittleEndian.AppendUint32(b, a.ID)
+	encrypt(key, b)
+	return b
+}
+
+// parseAuthenticator decrypts an authenticator with the given key.
+func parseAuthenticator(b, key []byte) (*authenticator, error) {
+	if len(b) != authentLen {
+		return nil, errMsg
+	}
+	b = append([]byte(nil), b...)
+	if err := decrypt(key, b); err != nil {
+		return nil, err
+	}
+	a := &authenticator{Num: b[0]}
+	copy(a.Chal[:], b[1:])
+	a.ID = binary.LittleEndian.Uint32(b[1+chalLen:])
+	return a, nil
+}
+
+// PassToKey derives the DES key of a user from a password (like the
+// Plan 9 passtokey function).
+func PassToKey(passwd string) []byte {
+	var buf [anameLen]byte
+	n := min(len(passwd), anameLen-1)
+	copy(buf[:8], "        ")
+	copy(buf[:], passwd[:n])
+	buf[n] = 0
+	key := make([]byte, desKeyLen)
+	off := 0
+	for {
+		t := buf[off:]
+		for i := range desKeyLen {
+			key[i] = (t[i] >> i) + (t[i+1] << (8 - (i + 1)))
+		}
+		if n <= 8 {
+			return key
+		}
+		n -= 8
+		off += 8
+		if n < 8 {
+			off -= 8 - n
+			n = 8
+		}
+		encrypt(key, buf[off:off+8])
+	}
+}
+
+// putName appends a NUL-padded name to a buffer.
+func putName(b []byte, name string, size int) []byte {
+	var field = make([]byte, size)
+	copy(field[:size-1], name)
+	return append(b, field...)
+}
+
+// getName decodes a NUL-padded name and returns the remaining buffer.
+func getName(b []byte, size int) (string, []byte) {
+	field := b[:size]
+	for i, c := range field {
+		if c == 0 {
+			field = field[:i]
+			break
+		}
+	}
+	return string(field), b[size:]
+}
+
+// desCipher returns a DES cipher for a 56-bit Plan 9 key: the key bits
+// are spread over eight bytes (with unused parity bits).
+func desCipher(key []byte) cipher.Block {
+	hi := binary.BigEndian.Uint32(key)
+	lo := uint32(key[4])<<24 | uint32(key[5])<<16 | uint32(key[6])<<8
+	k := []byte{
+		byte(hi >> 24),
+		byte(hi >> 17),
+		byte(hi >> 10),
+		byte(hi >> 3),
+		byte(hi<<4 | lo>>28),
+		byte(lo >> 21),
+		byte(lo >> 14),
+		byte(lo >> 7),
+	}
+	blk, _ := des.NewCipher(k)
+	return blk
+}
+
+// encrypt a buffer (of at least 8 bytes) in place like the Plan 9 encrypt
+// function: overlapping blocks are encrypted in steps of 7 bytes.
+func encrypt(key, buf []byte) {
+	if len(buf) < 8 {
+		return
+	}
+	blk := desCipher(key)
+	n := len(buf) - 1
+	r, n := n%7, n/7
+	for i := range n {
+		b := buf[7*i : 7*i+8]
+		blk.Encrypt(b, b)
+	}
+	if r > 0 {
+		b := buf[7*n-7+r : 7*n+1+r]
+		blk.Encrypt(b, b)
+	}
+}
+
+// decrypt a buffer encrypted with encrypt.
+func decrypt(key, buf []byte) error {
+	if len(key) != desKeyLen {
+		return errKey
+	}
+	if len(buf) < 8 {
+		return nil
+	}
+	blk := desCipher(key)
+	n := len(buf) - 1
+	r, n := n%7, n/7
+	if r > 0 {
+		b := buf[7*n-7+r : 7*n+1+r]
+		blk.Decrypt(b, b)
+	}
+	for i := n - 1; i >= 0; i-- {
+		b := buf[7*i : 7*i+8]
+		blk.Decrypt(b, b)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------
+// Plan 9 shared key authentication ("p9sk1"):
+//
+//   C->S: CHc
+//   S->C: authTreq, IDs, DN, CHs, -, -
+//   C->A: authTreq, IDs, DN, CHs, IDc, IDr
+//   A->C: Kc{authTc, CHs, IDc, IDr, Kn}, Ks{authTs, CHs, IDc, IDr, Kn}
+//   C->S: Ks{authTs, CHs, IDc, IDr, Kn}, Kn{authAc, CHs}
+//   S->C: Kn{authAs, CHc}
+//
+// The client obtains the tickets from the auth server (A) of the domain
+// DN; the server only needs to know its own key Ks.
+//----------------------------------------------------------------------
+
+// p9sk1Proto is the Plan 9 shared key protocol.
+type p9sk1Proto struct {
+	id  string // server user (IDs)
+	dom string // authentication domain
+	key []byte // DES key of server user
+}
+
+// NewP9sk1Auth returns the Plan 9 shared key protocol for the server user
+// id in authentication domain dom; key is the DES key of the server user
+// (see PassToKey).
+func NewP9sk1Auth(id, dom string, key []byte) AuthProto {
+	return &p9sk1Proto{id: id, dom: dom, key: key}
+}
+
+// Name of the protocol
+func (p *p9sk1Proto) Name() string {
+	return "p9sk1"
+}
+
+// New conversation for user.
+func (p *p9sk1Proto) New(user string) (AuthConv, error) {
+	if len(p.key) != desKeyLen {
+		return nil, errKey
+	}
+	return &p9sk1Conv{p: p}, nil
+}
+
+// p9sk1Conv is the server side of a p9sk1 conversation.
+type p9sk1Conv struct {
+	p     *p9sk1Proto
+	phase int           // protocol step
+	cchal [chalLen]byte // client challenge
+	tr    ticketReq     // ticket request sent to client
+	in    []byte        // partial client message
+	out   []byte        // next message for client
+	user  string        // authenticated user
+}
+
+// Read the next message for the client.
+func (c *p9sk1Conv) Read() ([]byte, error) {
+	if c.out == nil {
+		return nil, errAuthPhase
+	}
+	out := c.out
+	c.out = nil
+	return out, nil
+}
+
+// Write a message from the client.
+func (c *p9sk1Conv) Write(p []byte) error {
+	need := chalLen
+	if c.phase == 1 {
+		need = ticketLen + authentLen
+	}
+	if c.out != nil || c.phase > 1 {
+		return errAuthPhase
+	}
+	if c.in = append(c.in, p...); len(c.in) < need {
+		return nil
+	}
+	if len(c.in) > need {
+		return errAuthPhase
+	}
+	in := c.in
+	c.in = nil
+	if c.phase == 0 {
+		// client challenge: send ticket request
+		copy(c.cchal[:], in)
+		c.tr = ticketReq{
+			Type:    authTreq,
+			AuthID:  c.p.id,
+			AuthDom: c.p.dom,
+		}
+		rand.Read(c.tr.Chal[:])
+		c.out = c.tr.Bytes()
+		c.phase++
+		return nil
+	}
+	// ticket and authenticator: send server authenticator
+	t, err := parseTicket(in[:ticketLen], c.p.key)
+	if err != nil {
+		return err
+	}
+	if t.Num != authTs || t.Chal != c.tr.Chal {
+		return errAuthFail
+	}
+	a, err := parseAuthenticator(in[ticketLen:], t.Key)
+	if err != nil {
+		return err
+	}
+	if a.Num != authAc || a.Chal != c.tr.Chal || a.ID != 0 {
+		return errAuthFail
+	}
+	a = &authenticator{Num: authAs, Chal: c.cchal}
+	c.out = a.Bytes(t.Key)
+	c.user = t.SUid
+	c.phase++
+	return nil
+}
+
+// User returns the authenticated user.
+func (c *p9sk1Conv) User() string {
+	return c.user
+}
@@ -0,0 +1,321 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Error messages
+var (
+	ErrServerClosed = errors.New("server closed")
+)
+
+// Server serves a namespace on connections accepted from a listener (like
+// the listener returned by Device.SetupListener). It keeps track of live
+// connections, closes idle connections and can be shut down gracefully.
+// Lifecycle events are reported to the status display (if not nil).
+//
+// A server can't be restarted after it is shut down: a new server (with
+// a new listener) can serve the same namespace.
+type Server struct {
+	// IdleTimeout closes connections without requests in progress for the
+	// given time (0: never). Blocking reads keep a connection busy.
+	IdleTimeout time.Duration
+
+	ns     *Namespace         // served namespace
+	lst    net.Listener       // listener for client connections
+	state  *Status            // status display (or nil)
+	links  map[*link]struct{} // live connections
+	closed bool               // server shut down
+	done   chan struct{}      // closed when the server is shut down
+	wg     sync.WaitGroup     // connection handlers
+	mtx    sync.Mutex         // lock for links and closed
+}
+
+// NewServer creates a server for a namespace on a listener.
+func NewServer(ns *Namespace, lst net.Listener, state *Status) *Server {
+	return &Server{
+		ns:    ns,
+		lst:   lst,
+		state: state,
+		links: make(map[*link]struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Serve accepts and serves client connections until the server is shut
+// down (returning ErrServerClosed) or the listener fails. Failing accepts
+// are reported (StatSRV); temporary failures are retried.
+func (srv *Server) Serve() error {
+	srv.state.Set(StatOK, 0)
+	if d := srv.IdleTimeout; d > 0 {
+		go srv.reap(d)
+	}
+	var delay time.Duration
+	for {
+		nc, err := srv.lst.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			srv.state.Set(StatSRV, 3)
+			if !temporary(err) {
+				return err
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		l := newLink(nc)
+		srv.mtx.Lock()
+		if srv.closed {
+			srv.mtx.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		srv.links[l] = struct{}{}
+		srv.wg.Add(1)
+		srv.mtx.Unlock()
+
+		go func() {
+			defer srv.wg.Done()
+			defer srv.remove(l)
+			srv.ns.serveConn(nc, l)
+		}()
+	}
+}
+
+// temporary returns true if a failed accept can be retried.
+func temporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// Conns returns the number of live connections.
+func (srv *Server) Conns() int {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	return len(srv.links)
+}
+
+// Shutdown stops the server gracefully: the listener is closed, blocking
+// reads are interrupted and connections are closed as soon as their
+// requests in progress are answered. If the context expires first, all
+// connections are closed (see Close) and the context error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	links := srv.stop()
+	for _, l := range links {
+		l.drain()
+	}
+	fin := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(fin)
+	}()
+	select {
+	case <-fin:
+		return nil
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately: the listener and all connections
+// are closed.
+func (srv *Server) Close() error {
+	for _, l := range srv.stop() {
+		l.kill()
+	}
+	return nil
+}
+
+// stop accepting connections; returns the live connections.
+func (srv *Server) stop() []*link {
+	srv.mtx.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+		srv.lst.Close()
+		srv.state.Set(StatSTOP, 0)
+	}
+	links := make([]*link, 0, len(srv.links))
+	for l := range srv.links {
+		links = append(links, l)
+	}
+	srv.mtx.Unlock()
+	return links
+}
+
+// isClosed returns true if the server is shut down.
+func (srv *Server) isClosed() bool {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	return srv.closed
+}
+
+// remove a closed connection.
+func (srv *Server) remove(l *link) {
+	l.nc.Close()
+	srv.mtx.Lock()
+	delete(srv.links, l)
+	srv.mtx.Unlock()
+}
+
+// reap closes idle connections until the server is shut down.
+func (srv *Server) reap(d time.Duration) {
+	tick := time.NewTicker(max(d/4, 10*time.Millisecond))
+	defer tick.Stop()
+	for {
+		select {
+		case <-srv.done:
+			return
+		case <-tick.C:
+		}
+		srv.mtx.Lock()
+		for l := range srv.links {
+			if l.idle(d) {
+				l.nc.Close()
+			}
+		}
+		srv.mtx.Unlock()
+	}
+}
+
+//----------------------------------------------------------------------
+
+// link tracks the activity of a client connection served by a Server.
+// The methods can be called on a nil link (untracked connection).
+type link struct {
+	nc    net.Conn   // client transport
+	busy  int        // requests in progress
+	last  time.Time  // time of last activity
+	stop  bool       // close the connection when idle
+	gone  bool       // connection closed by the server
+	intr  func()     // interrupt blocking reads
+	mtx   sync.Mutex // lock for link state
+	quiet *sync.Cond // signaled when no requests are in progress
+}
+
+// newLink for a client transport.
+func newLink(nc net.Conn) *link {
+	l := &link{
+		nc:   nc,
+		last: time.Now(),
+	}
+	l.quiet = sync.NewCond(&l.mtx)
+	return l
+}
+
+// begin processing a request.
+func (l *link) begin() {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.busy++
+	l.last = time.Now()
+}
+
+// end processing a request: a draining connection is closed when the
+// last request is answered.
+func (l *link) end() {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.busy--
+	l.last = time.Now()
+	if l.busy == 0 {
+		l.quiet.Broadcast()
+		if l.stop {
+			l.nc.Close()
+		}
+	}
+}
+
+// draining returns true if no new requests should be read. The caller
+// waits until the requests in progress are answered.
+func (l *link) draining() bool {
+	if l == nil {
+		return false
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !l.stop {
+		return false
+	}
+	for l.busy > 0 && !l.gone {
+		l.quiet.Wait()
+	}
+	return true
+}
+
+// watch sets the function interrupting blocking reads.
+func (l *link) watch(intr func()) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.intr = intr
+}
+
+// drain the connection: blocking reads are interrupted and the connection
+// is closed when the requests in progress are answered.
+func (l *link) drain() {
+	l.mtx.Lock()
+	l.stop = true
+	intr, quiet := l.intr, l.busy == 0
+	l.mtx.Unlock()
+	if intr != nil {
+		intr()
+	}
+	if quiet {
+		l.nc.Close()
+	}
+}
+
+// kill closes the connection immediately.
+func (l *link) kill() {
+	l.mtx.Lock()
+	l.stop, l.gone = true, true
+	l.quiet.Broadcast()
+	l.mtx.Unlock()
+	l.nc.Close()
+}
+
+// idle returns true if the connection had no requests in progress for
+// the given time.
+func (l *link) idle(d time.Duration) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.busy == 0 && time.Since(l.last) >= d
+}
@@ -0,0 +1,322 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer serves a namespace on a local TCP port.
+func startServer(t *testing.T, ns *Namespace, idle time.Duration) (*Server, string, chan error) {
+	t.Helper()
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(ns, lst, nil)
+	srv.IdleTimeout = idle
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve()
+	}()
+	return srv, lst.Addr().String(), errc
+}
+
+// dialServer connects to a server and negotiates the protocol version.
+func dialServer(t *testing.T, addr, version string) *testClient {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, conn: nc, tag: 0xffff}
+	var b msgBuf
+	if _, _, err = c.rpc(msgTversion, b.u32(8192+ioHdrSize).str(version)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// waitConns waits for the number of live connections of a server.
+func waitConns(t *testing.T, srv *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); srv.Conns() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections", srv.Conns())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitBusy waits for a request in progress on a server.
+func waitBusy(t *testing.T, srv *Server) {
+	t.Helper()
+	busy := func() bool {
+		srv.mtx.Lock()
+		defer srv.mtx.Unlock()
+		for l := range srv.links {
+			if !l.idle(0) {
+				return true
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(5 * time.Second); !busy(); {
+		if time.Now().After(deadline) {
+			t.Fatal("no request in progress")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// closed checks that the server closed a connection.
+func closed(t *testing.T, c *testClient) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if typ, _, _, err := c.recv(); typ != 0 || err == nil {
+		t.Fatalf("connection open: %d, %v", typ, err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/events", 0444, NewEventFile(4)); err != nil {
+		t.Fatal(err)
+	}
+	srv, addr, errc := startServer(t, ns, 0)
+
+	// client with a blocking read
+	c1 := dialServer(t, addr, "9P2000")
+	if err = c1.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c1.walk(0, 1, "events"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c1.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	var b msgBuf
+	tag := c1.send(msgTread, b.u32(1).u64(0).u32(64))
+	waitBusy(t, srv)
+
+	// idle clients (classic and 9P2000.L)
+	c2 := dialServer(t, addr, "9P2000")
+	c3 := dialServer(t, addr, "9P2000.L")
+	waitConns(t, srv, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// blocking read is answered before the connection is closed
+	if _, rtag, _, err := c1.recv(); rtag != tag || err == nil || err.Error() != errIntr.Error() {
+		t.Fatalf("blocking read: %d, %v", rtag, err)
+	}
+	closed(t, c1)
+	closed(t, c2)
+	closed(t, c3)
+	if err = <-errc; err != ErrServerClosed {
+		t.Fatalf("serve: %v", err)
+	}
+	if n := srv.Conns(); n != 0 {
+		t.Fatalf("%d connections", n)
+	}
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Fatal("connected after shutdown")
+	}
+
+	// serve the namespace again
+	srv, addr, errc = startServer(t, ns, 0)
+	c4 := dialServer(t, addr, "9P2000")
+	if err = c4.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed(t, c4)
+	if err = <-errc; err != ErrServerClosed {
+		t.Fatalf("serve: %v", err)
+	}
+}
+
+func TestServerIdle(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ns.NewFile("/events", 0444, NewEventFile(4)); err != nil {
+		t.Fatal(err)
+	}
+	srv, addr, _ := startServer(t, ns, 50*time.Millisecond)
+	defer srv.Close()
+
+	// idle client is closed
+	c1 := dialServer(t, addr, "9P2000")
+	closed(t, c1)
+
+	// client waiting for an event is busy
+	c2 := dialServer(t, addr, "9P2000")
+	if err = c2.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c2.walk(0, 1, "events"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c2.open(1, OREAD); err != nil {
+		t.Fatal(err)
+	}
+	var b msgBuf
+	c2.send(msgTread, b.u32(1).u64(0).u32(64))
+	waitBusy(t, srv)
+	time.Sleep(200 * time.Millisecond)
+	waitConns(t, srv, 1)
+	e, _ := ns.Get("/events")
+	e.file.(*EventFile).Post([]byte("click"))
+	if _, _, body, err := c2.recv(); err != nil || string(body[4:]) != "click" {
+		t.Fatalf("event: %q, %v", body, err)
+	}
+	closed(t, c2)
+}
+
+func TestServerDeadline(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// file blocking on open
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	err = ns.NewFile("/slow", 0444, NewFuncFile(func() ([]byte, error) {
+		close(entered)
+		<-release
+		return nil, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, addr, _ := startServer(t, ns, 0)
+	c := dialServer(t, addr, "9P2000")
+	if err = c.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.walk(0, 1, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	var b msgBuf
+	c.send(msgTopen, b.u32(1).u8(OREAD))
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown: %v", err)
+	}
+	closed(t, c)
+}
+
+func TestServerServeConn(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ServeConn returns to its caller when the client is gone
+	for _, version := range []string{"9P2000", dialectL} {
+		srv, cli := net.Pipe()
+		fin := make(chan struct{})
+		go func() {
+			ns.ServeConn(srv)
+			close(fin)
+		}()
+		c := &testClient{t: t, conn: cli, tag: 0xffff}
+		var b msgBuf
+		if _, _, err = c.rpc(msgTversion, b.u32(8192+ioHdrSize).str(version)); err != nil {
+			t.Fatal(err)
+		}
+		cli.Close()
+		select {
+		case <-fin:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: ServeConn still running", version)
+		}
+	}
+}
+
+// flakyListener fails with a temporary error before accepting.
+type flakyListener struct {
+	net.Listener
+	fails int
+}
+
+// tempErr is a temporary accept error.
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary failure" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, tempErr{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptError(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(ns, &flakyListener{Listener: lst, fails: 3}, nil)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve() }()
+
+	// temporary errors are retried
+	c := dialServer(t, lst.Addr().String(), "9P2000")
+	if err = c.attach(0, nofid, "glenda"); err != nil {
+		t.Fatal(err)
+	}
+	// a listener closed elsewhere ends the server
+	lst.Close()
+	select {
+	case err = <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still accepting")
+	}
+	srv.Close()
+}
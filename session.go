@@ -0,0 +1,1047 @@
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"strings"
+
+	"git.sr.ht/~moody/ninep"
+)
+
+// Error messages
+var (
+	errOffset  = errors.New("bad offset in directory read")
+	errShort   = errors.New("read count too small for directory entry")
+	errIntr    = errors.New("interrupted")
+	errRange   = errors.New("offset out of range")
+	errNotOpen = errors.New("fid not open for I/O")
+)
+
+// handle is the state of an opened fid. The content of a file (or the
+// listing of a directory) is captured when the entry is opened, so all
+// reads on the fid return a coherent view of the entry.
+type handle struct {
+	entry *Entry      // opened entry
+	mode  byte        // open mode
+	file  File        // file implementation for this fid
+	data  []byte      // content snapshot (nil if not captured)
+	dirs  []ninep.Dir // directory listing
+	off   uint64      // offset of next directory read
+	idx   int         // index of next directory entry
+
+	ctx    context.Context    // context for blocking reads
+	cancel context.CancelFunc // cancel blocking reads
+	excl   bool               // exclusive use of entry (DMExcl)
+	conv   *conv              // referenced resource directory (clone files)
+}
+
+// close the file of a handle (if it wants to be notified). Pending
+// blocking reads are canceled, exclusive use of the entry ends and the
+// reference to a resource directory is released.
+func (h *handle) close() (err error) {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.excl {
+		h.entry.ns.reserve(h.entry, false)
+	}
+	if c, ok := h.file.(io.Closer); ok {
+		err = c.Close()
+	}
+	if h.conv != nil {
+		h.conv.release()
+	}
+	return
+}
+
+//----------------------------------------------------------------------
+
+// session implements the 9p protocol handlers (ninep.FS) on a namespace
+// for an attached client.
+type session struct {
+	ninep.NopFS            // use default handlers where needed
+	ns          *Namespace // served namespace
+	conn        *conn      // client connection
+	user        string     // attached user
+	aname       string     // attach name
+}
+
+// ServeConn serves the namespace on a client connection. Clients must
+// authenticate if required (see SetAuth). Clients negotiating the
+// 9P2000.L dialect (like the Linux kernel) or the 9P2000.u dialect are
+// served by translating their requests to classic 9P. ServeConn returns
+// when the connection is closed.
+func (ns *Namespace) ServeConn(rw io.ReadWriter) {
+	ns.serveConn(rw, nil)
+}
+
+// serveConn serves a client connection (tracked by a link if not nil).
+func (ns *Namespace) serveConn(rw io.ReadWriter, l *link) {
+	var remote string
+	if ra, ok := rw.(interface{ RemoteAddr() net.Addr }); ok {
+		remote = ra.RemoteAddr().String()
+	}
+	first, err := readFrame(rw, ns.mem.limit(0))
+	if err != nil {
+		closeTransport(rw)
+		return
+	}
+	if first[4] == msgTversion {
+		if v := dialect(first[hdrSize:]); len(v) > 0 {
+			ns.serveDialect(rw, v, first, remote, l)
+			return
+		}
+	}
+	ns.serve(&peeked{io.MultiReader(bytes.NewReader(first), rw), rw}, remote, l, true)
+}
+
+// peeked is a client transport with a request already read from it.
+type peeked struct {
+	io.Reader               // peeked request followed by the transport
+	rw        io.ReadWriter // transport
+}
+
+// Write to the transport.
+func (p *peeked) Write(b []byte) (int, error) {
+	return p.rw.Write(b)
+}
+
+// Close the transport.
+func (p *peeked) Close() error {
+	closeTransport(p.rw)
+	return nil
+}
+
+// serve classic 9P on a client connection. Blocking reads can be
+// interrupted through the link; requests are tracked by the link if
+// track is set (and not by a translator serving the client).
+func (ns *Namespace) serve(rw io.ReadWriter, remote string, l *link, track bool) {
+	c := newConn(rw, ns)
+	c.remote = remote
+	if track {
+		c.link = l
+	}
+	l.watch(c.interrupt)
+	srv := ninep.NewSrv(func() ninep.FS {
+		return &session{ns: ns, conn: c}
+	})
+	// the ninep reader ends its goroutine when the connection is closed
+	// (see conn.close), so it doesn't run on the caller's goroutine.
+	fin := make(chan struct{})
+	go func() {
+		defer close(fin)
+		srv.ServeIO(c, c)
+	}()
+	<-fin
+}
+
+// Client identifies the client on whose behalf a file operation is
+// performed (see ContextFile).
+type Client struct {
+	User   string // attached user
+	Aname  string // attach name (file tree requested by the client)
+	Remote string // remote address of the connection (if known)
+	Conn   uint64 // connection identifier (unique in the process)
+	Fid    uint32 // fid used in the request
+}
+
+// key for client information in a context
+type clientKey struct{}
+
+// ClientFrom returns the client information from the context passed to
+// a file operation.
+func ClientFrom(ctx context.Context) (*Client, bool) {
+	c, ok := ctx.Value(clientKey{}).(*Client)
+	return c, ok
+}
+
+// context returns a context with information about the client for the
+// current request.
+func (s *session) context() context.Context {
+	return context.WithValue(context.Background(), clientKey{}, &Client{
+		User:   s.user,
+		Aname:  s.aname,
+		Remote: s.conn.remote,
+		Conn:   s.conn.id,
+		Fid:    s.conn.fid,
+	})
+}
+
+// read the content of a file for the current request.
+func (s *session) read(f File) ([]byte, error) {
+	if cf, ok := f.(ContextFile); ok {
+		return cf.ReadContext(s.context())
+	}
+	return f.Read()
+}
+
+// write the content of a file for the current request.
+func (s *session) write(f File, data []byte) error {
+	if cf, ok := f.(ContextFile); ok {
+		return cf.WriteContext(s.context(), data)
+	}
+	return f.Write(data)
+}
+
+//----------------------------------------------------------------------
+
+// Attach to 9p session. The user name given by the client is used
+// for permission checks in the session.
+func (s *session) Attach(t *ninep.Tattach) {
+	s.user = t.Uname
+	if len(s.user) == 0 {
+		s.user = "none"
+	}
+	s.aname = t.Aname
+	root := s.ns.lookup(0)
+	if root == nil {
+		t.Err(errNoRoot)
+		return
+	}
+	qid := s.ns.qid(root)
+	t.Respond(&qid)
+}
+
+// Walk to child entry with name "next". The user needs execute
+// permission on the directory.
+func (s *session) Walk(cur *ninep.Qid, next string) *ninep.Qid {
+	e := s.ns.lookup(cur.Path)
+	if e == nil || !s.allowed(s.ns.union(e)[0], ninep.DMExec) {
+		return nil
+	}
+	if c := s.ns.next(e, next); c != nil {
+		qid := s.ns.qid(c)
+		return &qid
+	}
+	return nil
+}
+
+// Open entry for file operation. A new handle for the fid is created that
+// holds a snapshot of the file content (unless the file is read in slices)
+// or a per-open file instance (if the file implements Handler). Files
+// implementing Opener are notified (and can reject the request).
+//
+// ninep keeps fids private, but it stores the Qid returned in the response
+// as reference for the fid: the Qid pointer passed to all handlers called
+// for an opened fid identifies its handle. Walks from opened fids (which
+// would share the Qid) are rejected by the connection (see conn.filter).
+func (s *session) Open(t *ninep.Topen, q *ninep.Qid) {
+	if _, h := s.ns.file(nil, q); h != nil {
+		t.Err(errOpen)
+		return
+	}
+	e := s.ns.lookup(q.Path)
+	if e == nil {
+		t.Err(errNoFile)
+		return
+	}
+	m := s.ns.union(e)[0]
+	m.ns.mtx.RLock()
+	err := s.access(m, t.Mode)
+	m.ns.mtx.RUnlock()
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	qid, err := s.openEntry(e, t.Mode)
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	t.Respond(qid, s.conn.iounit())
+}
+
+// access checks if the user can open an entry with given mode.
+func (s *session) access(e *Entry, mode byte) error {
+	var want uint32
+	switch mode & 3 {
+	case OREAD:
+		want = ninep.DMRead
+	case OWRITE:
+		want = ninep.DMWrite
+	case ORDWR:
+		want = ninep.DMRead | ninep.DMWrite
+	case OEXEC:
+		want = ninep.DMExec
+	}
+	if mode&OTRUNC != 0 {
+		want |= ninep.DMWrite
+	}
+	if e.IsDir() && want&ninep.DMWrite != 0 {
+		return errIsDir
+	}
+	if !s.perm(e, want) {
+		return errPerm
+	}
+	if mode&ORCLOSE != 0 {
+		if parent := e.parent; parent == nil || !s.perm(parent, ninep.DMWrite) {
+			return errPerm
+		}
+	}
+	return nil
+}
+
+// perm checks if the user has the requested access (combination of
+// DMRead, DMWrite and DMExec) to an entry. The permission bits for
+// others, the owner and the group are checked (in that order). The
+// namespace of the entry is locked by the caller.
+func (s *session) perm(e *Entry, want uint32) bool {
+	if e == nil {
+		return false
+	}
+	mode := e.ref.Mode & 7
+	if mode&want == want {
+		return true
+	}
+	if s.user == e.ref.Uid {
+		if mode |= (e.ref.Mode >> 6) & 7; mode&want == want {
+			return true
+		}
+	}
+	if s.ns.member(s.user, e.ref.Gid) {
+		if mode |= (e.ref.Mode >> 3) & 7; mode&want == want {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks permissions on an entry (see perm).
+func (s *session) allowed(e *Entry, want uint32) bool {
+	e.ns.mtx.RLock()
+	defer e.ns.mtx.RUnlock()
+	return s.perm(e, want)
+}
+
+// open an entry with given mode and return the Qid reference for the fid.
+// The file content is truncated if requested. If the open fails, the
+// partially set up handle is closed.
+func (s *session) openEntry(e *Entry, mode byte) (qid *ninep.Qid, err error) {
+	h := &handle{
+		entry: e,
+		mode:  mode,
+	}
+	defer func() {
+		if err != nil {
+			h.close()
+		}
+	}()
+	e.ns.mtx.RLock()
+	excl := e.ref.Mode&ninep.DMExcl != 0
+	e.ns.mtx.RUnlock()
+	if excl {
+		if !e.ns.reserve(e, true) {
+			return nil, errExcl
+		}
+		h.excl = true
+	}
+	if conv := e.ns.resource(e); conv != nil {
+		if !conv.acquire() {
+			return nil, errNoFile
+		}
+		h.conv = conv
+	}
+	if !e.IsDir() {
+		file := e.file
+		if hdlr, ok := e.file.(Handler); ok {
+			if file, err = hdlr.Handle(); err != nil {
+				return nil, err
+			}
+			// a per-open file is closed even if it rejects the open
+			h.file = file
+		}
+		if op, ok := file.(Opener); ok {
+			if err = op.Open(mode); err != nil {
+				return nil, err
+			}
+		}
+		h.file = file
+		if mode&OTRUNC != 0 {
+			if err = s.write(h.file, nil); err != nil {
+				return nil, err
+			}
+		}
+		switch h.file.(type) {
+		case Poller:
+			h.ctx, h.cancel = context.WithCancel(s.context())
+		case io.ReaderAt:
+		default:
+			if mode&3 == OWRITE {
+				break
+			}
+			var data []byte
+			if data, err = s.read(h.file); err != nil {
+				return nil, err
+			}
+			if data == nil {
+				data = []byte{}
+			}
+			h.data = data
+		}
+	} else {
+		h.file = e.file
+		if h.dirs, err = s.ns.listing(e); err != nil {
+			return nil, err
+		}
+	}
+	volatile := false
+	if v, ok := h.file.(Volatile); ok {
+		volatile = v.Volatile()
+	}
+	e.ns.mtx.Lock()
+	if !e.IsDir() && mode&OTRUNC != 0 {
+		e.modified(s.user)
+	} else if volatile {
+		e.modified("")
+	}
+	e.ns.mtx.Unlock()
+
+	qid = new(ninep.Qid)
+	*qid = s.ns.qid(e)
+	s.ns.hmtx.Lock()
+	s.ns.open[qid] = h
+	s.ns.hmtx.Unlock()
+	s.conn.track(qid)
+	return qid, nil
+}
+
+// Create a new entry in a directory on behalf of a client. The directory
+// must accept new entries (see Entry.SetCreator); the new entry is opened
+// with the requested mode. In union directories the entry is created in
+// the first member accepting new entries.
+func (s *session) Create(t *ninep.Tcreate, q *ninep.Qid) {
+	e := s.ns.lookup(q.Path)
+	if e == nil {
+		t.Err(errNoFile)
+		return
+	}
+	dirs := s.ns.union(e)
+	dir := dirs[0]
+	for _, d := range dirs {
+		d.ns.mtx.RLock()
+		ok := d.create != nil
+		d.ns.mtx.RUnlock()
+		if ok {
+			dir = d
+			break
+		}
+	}
+	// check request
+	dir.ns.mtx.RLock()
+	err := s.creatable(dir, t.Name)
+	var perm uint32
+	var create CreateFunc
+	if err == nil {
+		// permissions are restricted by the directory permissions
+		perm = t.Perm & (^uint32(0666) | dir.ref.Mode&0666)
+		if t.Perm&ninep.DMDir != 0 {
+			perm = t.Perm & (^uint32(0777) | dir.ref.Mode&0777)
+		}
+		create = dir.create
+	}
+	dir.ns.mtx.RUnlock()
+	if err == nil && len(dirs) > 1 && s.ns.next(e, t.Name) != nil {
+		err = errExists
+	}
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	// get implementation for new entry
+	impl, err := create(t.Name, perm)
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	if perm&ninep.DMDir != 0 {
+		impl = nil
+	} else if impl == nil {
+		t.Err(errPerm)
+		return
+	}
+	// insert new entry (if the directory has not changed in the meantime)
+	ns := dir.ns
+	ns.mtx.Lock()
+	if err = s.creatable(dir, t.Name); err == nil {
+		e := ns.newEntry(t.Name, s.user, dir.ref.Gid, perm, impl)
+		if e.IsDir() {
+			e.create = dir.create
+		}
+		ns.insert(dir, e)
+		ns.mtx.Unlock()
+
+		var qid *ninep.Qid
+		if qid, err = s.openEntry(e, t.Mode); err == nil {
+			t.Respond(qid, s.conn.iounit())
+			return
+		}
+		ns.mtx.Lock()
+		ns.remove(e, true)
+	}
+	ns.mtx.Unlock()
+	t.Err(err)
+}
+
+// creatable checks if the user can create a new entry with given name
+// in a directory (namespace of the directory locked by caller).
+func (s *session) creatable(dir *Entry, name string) error {
+	if dir.ns.dict[dir.ref.Path] != dir {
+		return errNoFile
+	}
+	if !dir.IsDir() {
+		return errNoDir
+	}
+	if dir.create == nil || dir.list != nil || !s.perm(dir, ninep.DMWrite) {
+		return errPerm
+	}
+	if !validName(name) {
+		return errName
+	}
+	if _, ok := dir.children[name]; ok {
+		return errExists
+	}
+	return nil
+}
+
+// Clunk releases the handle of an opened fid. Files implementing io.Closer
+// are notified; an error is reported to the client, but the fid is
+// released anyway. Files opened with ORCLOSE are removed.
+func (s *session) Clunk(t *ninep.Tclunk, q *ninep.Qid) {
+	h := s.ns.release(q)
+	if h == nil {
+		t.Respond()
+		return
+	}
+	s.conn.track(nil)
+	err := h.close()
+	if h.mode&ORCLOSE != 0 {
+		if rerr := s.unlink(h.entry); err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	t.Respond()
+}
+
+// Remove entry on behalf of a client. The fid is clunked even if the
+// removal fails.
+func (s *session) Remove(t *ninep.Tremove, q *ninep.Qid) {
+	var err error
+	if h := s.ns.release(q); h != nil {
+		s.conn.track(nil)
+		err = h.close()
+	}
+	e := s.ns.lookup(q.Path)
+	if e == nil {
+		t.Err(errNoFile)
+		return
+	}
+	if rerr := s.unlink(e); rerr != nil {
+		err = rerr
+	}
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	t.Respond()
+}
+
+// unlink an entry on behalf of a client: the user needs write permission
+// on the parent directory and the entry must agree to be removed.
+func (s *session) unlink(e *Entry) error {
+	check := func() error {
+		if !s.perm(e.parent, ninep.DMWrite) || e.parent.list != nil {
+			return errPerm
+		}
+		if len(e.children) > 0 {
+			return errEmpty
+		}
+		return nil
+	}
+	ns := e.ns
+	ns.mtx.RLock()
+	err := check()
+	hook := e.remove
+	ns.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	if hook != nil {
+		if err = hook(); err != nil {
+			return err
+		}
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if err = check(); err != nil {
+		return err
+	}
+	return ns.remove(e, false)
+}
+
+// file returns the file implementation and handle (if opened) to be
+// used for the given fid.
+func (ns *Namespace) file(e *Entry, q *ninep.Qid) (File, *handle) {
+	ns.hmtx.Lock()
+	defer ns.hmtx.Unlock()
+	if h, ok := ns.open[q]; ok {
+		return h.file, h
+	}
+	if e == nil {
+		return nil, nil
+	}
+	return e.file, nil
+}
+
+// reserve (or release) an exclusive-use entry. Returns false if the
+// entry is already reserved.
+func (ns *Namespace) reserve(e *Entry, flag bool) bool {
+	ns.hmtx.Lock()
+	defer ns.hmtx.Unlock()
+	if flag && ns.excl[e] {
+		return false
+	}
+	if flag {
+		ns.excl[e] = true
+	} else {
+		delete(ns.excl, e)
+	}
+	return true
+}
+
+// release the handle of a fid (if opened).
+func (ns *Namespace) release(q *ninep.Qid) *handle {
+	ns.hmtx.Lock()
+	defer ns.hmtx.Unlock()
+	h, ok := ns.open[q]
+	if ok {
+		delete(ns.open, q)
+	}
+	return h
+}
+
+// Read from an opened fid. Either return the content of a file
+// or the listing from a directory. Files implementing io.ReaderAt
+// are read in slices.
+func (s *session) Read(t *ninep.Tread, q *ninep.Qid) {
+	e := s.ns.lookup(q.Path)
+	if e == nil {
+		t.Err(errNoFile)
+		return
+	}
+	file, h := s.ns.file(e, q)
+	if h == nil {
+		t.Err(errNotOpen)
+		return
+	}
+	if h.mode&3 == OWRITE {
+		t.Err(errPerm)
+		return
+	}
+	if t.Offset > math.MaxInt64 {
+		t.Err(errRange)
+		return
+	}
+	if e.IsDir() {
+		for _, d := range s.ns.union(e) {
+			d.accessed()
+		}
+		h.readDir(t)
+		return
+	}
+	e.accessed()
+
+	if p, ok := file.(Poller); ok {
+		s.poll(t, h, p)
+		return
+	}
+	if h.data != nil {
+		ninep.ReadBuf(t, h.data)
+		return
+	}
+	if r, ok := file.(io.ReaderAt); ok {
+		count := int64(t.Count)
+		if s, ok := file.(Sizer); ok {
+			if count = min(count, s.Size()-int64(t.Offset)); count <= 0 {
+				t.Respond([]byte{})
+				return
+			}
+		}
+		buf := make([]byte, count)
+		n, err := r.ReadAt(buf, int64(t.Offset))
+		if err != nil && err != io.EOF {
+			t.Err(err)
+			return
+		}
+		t.Respond(buf[:n])
+		return
+	}
+	data, err := s.read(file)
+	if err != nil {
+		t.Err(err)
+	} else {
+		ninep.ReadBuf(t, data)
+	}
+}
+
+// poll responds asynchronously to a read on a blocking file. Pending reads
+// are canceled if the client flushes the request or clunks the fid.
+func (s *session) poll(t *ninep.Tread, h *handle, p Poller) {
+	ctx, cancel := context.WithCancel(h.ctx)
+	req := s.conn.pend(cancel)
+	go func() {
+		defer cancel()
+		data, err := p.Poll(ctx)
+		if ctx.Err() != nil {
+			err = errIntr
+		}
+		s.conn.respond(req, func() {
+			if err != nil {
+				t.Err(err)
+				return
+			}
+			t.Respond(data[:min(len(data), int(t.Count))])
+		})
+	}()
+}
+
+// listing returns the content of a directory sorted by name. The content
+// of all union members is listed; entries found earlier hide entries with
+// the same name.
+func (ns *Namespace) listing(e *Entry) ([]ninep.Dir, error) {
+	var kids []*Entry
+	seen := make(map[string]bool)
+	for _, d := range ns.union(e) {
+		if err := d.refresh(); err != nil {
+			return nil, err
+		}
+		d.ns.mtx.RLock()
+		for name, c := range d.children {
+			if !seen[name] {
+				seen[name] = true
+				kids = append(kids, c)
+			}
+		}
+		d.ns.mtx.RUnlock()
+	}
+	list := make([]ninep.Dir, len(kids))
+	for i, c := range kids {
+		list[i] = ns.stat(ns.view(c), nil)
+	}
+	slices.SortFunc(list, func(a, b ninep.Dir) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list, nil
+}
+
+// readDir responds to a directory read from the listing of a handle.
+// Reads must start at an entry (offset 0 or the end of a previous read)
+// and return complete entries only.
+func (h *handle) readDir(t *ninep.Tread) {
+	idx, off := 0, uint64(0)
+	if t.Offset == h.off {
+		idx, off = h.idx, h.off
+	}
+	for ; idx < len(h.dirs) && off < t.Offset; idx++ {
+		off += dirSize(&h.dirs[idx])
+	}
+	if off != t.Offset {
+		t.Err(errOffset)
+		return
+	}
+	end, n := idx, uint64(0)
+	for ; end < len(h.dirs); end++ {
+		size := dirSize(&h.dirs[end])
+		if n+size > uint64(t.Count) {
+			break
+		}
+		n += size
+	}
+	if end == idx && idx < len(h.dirs) {
+		t.Err(errShort)
+		return
+	}
+	h.off, h.idx = off+n, end
+	t.Offset = 0
+	ninep.ReadDir(t, h.dirs[idx:end])
+}
+
+// Write to an opened file. Files implementing io.WriterAt receive the
+// written data at the given offset; other file implementations receive
+// the current content with the written data spliced in at the offset;
+// the gap between the end of the file and the offset is limited (see
+// Limits.Growth).
+func (s *session) Write(t *ninep.Twrite, q *ninep.Qid) {
+	e := s.ns.lookup(q.Path)
+	if e == nil {
+		t.Err(errNoFile)
+		return
+	}
+	var err error
+	file, h := s.ns.file(e, q)
+	if h == nil {
+		err = errNotOpen
+	} else if e.IsDir() {
+		err = errIsDir
+	} else if h.mode&3 != OWRITE && h.mode&3 != ORDWR {
+		err = errPerm
+	} else if t.Offset > math.MaxInt64 {
+		err = errRange
+	}
+	if err != nil {
+		t.Err(err)
+		return
+	}
+	// writes to append-only files go to the end of the file
+	e.ns.mtx.RLock()
+	appendOnly := e.ref.Mode&ninep.DMAppend != 0
+	e.ns.mtx.RUnlock()
+	if appendOnly {
+		e.amtx.Lock()
+		defer e.amtx.Unlock()
+		if sz, ok := file.(Sizer); ok {
+			t.Offset = uint64(sz.Size())
+		} else {
+			curr, err := s.read(file)
+			if err != nil {
+				t.Err(err)
+				return
+			}
+			t.Offset = uint64(len(curr))
+		}
+	}
+	if w, ok := file.(io.WriterAt); ok {
+		if sz, ok := file.(Sizer); ok && t.Offset > uint64(sz.Size()+s.ns.mem.growth()) {
+			t.Err(errGrowth)
+			return
+		}
+		n, err := w.WriteAt(t.Data, int64(t.Offset))
+		if err != nil && n == 0 {
+			t.Err(err)
+			return
+		}
+		// snapshot is outdated
+		h.data = nil
+		s.modified(e)
+		t.Respond(uint32(n))
+		return
+	}
+	var curr []byte
+	if h.data != nil && !appendOnly {
+		curr = h.data
+	} else if curr, err = s.read(file); err != nil {
+		t.Err(err)
+		return
+	}
+	if t.Offset > uint64(len(curr))+uint64(s.ns.mem.growth()) {
+		t.Err(errGrowth)
+		return
+	}
+	// splice written data into the current content
+	off := int(t.Offset)
+	data := make([]byte, max(len(curr), off+len(t.Data)))
+	copy(data, curr)
+	copy(data[off:], t.Data)
+	if err = s.write(file, data); err != nil {
+		t.Err(err)
+		return
+	}
+	if h.data != nil {
+		h.data = data
+	}
+	s.modified(e)
+	t.Respond(uint32(len(t.Data)))
+}
+
+// modified marks the content of an entry as changed by the user.
+func (s *session) modified(e *Entry) {
+	e.ns.mtx.Lock()
+	defer e.ns.mtx.Unlock()
+	e.modified(s.user)
+}
+
+// Stat returns information for a filesytem entry. A Twstat request
+// is handed to the handler as Tstat with the requested changes attached
+// to the connection (see conn).
+func (s *session) Stat(t *ninep.Tstat, q *ninep.Qid) {
+	e := s.ns.lookup(q.Path)
+	if e != nil {
+		// generated entries might have changed or vanished
+		if e.parent.refresh() != nil || e.refresh() != nil {
+			e = nil
+		} else {
+			e = s.ns.lookup(q.Path)
+		}
+	}
+	if e == nil {
+		t.Err(errNoFile)
+		return
+	}
+	if d := s.conn.wstat; d != nil {
+		s.conn.wstat = nil
+		if err := s.wstat(e, d); err != nil {
+			t.Err(err)
+			return
+		}
+	}
+	var snap []byte
+	if _, h := s.ns.file(e, q); h != nil {
+		snap = h.data
+	}
+	d := s.ns.stat(e, snap)
+	t.Respond(&d)
+}
+
+// stat returns the stat of an entry as served by the namespace (with the
+// content snapshot of an opened fid or nil). Union directories show the
+// stat of their first member.
+func (ns *Namespace) stat(e *Entry, snap []byte) ninep.Dir {
+	m := ns.union(e)[0]
+	d := m.stat(snap)
+	if m != e {
+		e.ns.mtx.RLock()
+		d.Name = e.ref.Name
+		e.ns.mtx.RUnlock()
+	}
+	d.Path = ns.path(e)
+	return d
+}
+
+// wstat changes the stat of an entry on behalf of a client. Fields with
+// "don't touch" values (empty strings, all bits set) are left unchanged.
+// Changes are only applied if all of them are permitted; files can grow
+// by the same amount as in writes (see Limits.Growth).
+func (s *session) wstat(e *Entry, d *ninep.Dir) error {
+	// check requested changes
+	rename := false
+	check := func() error {
+		if rename = len(d.Name) > 0 && d.Name != e.ref.Name; rename {
+			if !validName(d.Name) {
+				return errName
+			}
+			parent := e.parent
+			if !s.perm(parent, ninep.DMWrite) || parent.list != nil {
+				return errPerm
+			}
+			if _, ok := parent.children[d.Name]; ok {
+				return errExists
+			}
+		}
+		owner := s.user == e.ref.Uid
+		if d.Mode != ^uint32(0) && (!owner || (d.Mode^e.ref.Mode)&ninep.DMDir != 0) {
+			return errPerm
+		}
+		if d.Mtime != ^uint32(0) && !owner {
+			return errPerm
+		}
+		// only the namespace owner can change the owner of an entry; the group
+		// can also be changed by the entry owner if a member of the new group.
+		if len(d.Uid) > 0 && d.Uid != e.ref.Uid && s.user != s.ns.user {
+			return errPerm
+		}
+		if len(d.Gid) > 0 && d.Gid != e.ref.Gid && s.user != s.ns.user &&
+			!(owner && s.ns.member(s.user, d.Gid)) {
+			return errPerm
+		}
+		if d.Len != ^uint64(0) {
+			if e.IsDir() {
+				if d.Len != 0 {
+					return errIsDir
+				}
+			} else if !s.perm(e, ninep.DMWrite) {
+				return errPerm
+			}
+		}
+		return nil
+	}
+	ns := e.ns
+	ns.mtx.RLock()
+	err := check()
+	hook := e.wstat
+	ns.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if d.Len != ^uint64(0) && !e.IsDir() {
+		curr, err := s.read(e.file)
+		if err != nil {
+			return err
+		}
+		if d.Len > uint64(len(curr))+uint64(s.ns.mem.growth()) {
+			return errGrowth
+		}
+		if uint64(len(curr)) != d.Len {
+			data = make([]byte, d.Len)
+			copy(data, curr)
+		}
+	}
+	if hook != nil {
+		if err = hook(d); err != nil {
+			return err
+		}
+	}
+	// apply changes
+	if data != nil {
+		if err = s.write(e.file, data); err != nil {
+			return err
+		}
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if err = check(); err != nil {
+		return err
+	}
+	if rename {
+		parent := e.parent
+		delete(parent.children, e.ref.Name)
+		e.ref.Name = d.Name
+		parent.children[d.Name] = e
+		parent.modified(s.user)
+	}
+	if data != nil {
+		e.modified(s.user)
+	}
+	if d.Mode != ^uint32(0) {
+		e.ref.Mode = d.Mode
+		e.ref.Type = qidType(d.Mode)
+	}
+	if d.Mtime != ^uint32(0) {
+		e.ref.Mtime = d.Mtime
+	}
+	if len(d.Uid) > 0 {
+		e.ref.Uid = d.Uid
+	}
+	if len(d.Gid) > 0 {
+		e.ref.Gid = d.Gid
+	}
+	return nil
+}
@@ -42,6 +42,7 @@ const (
 	StatLISTEN2        // failed to initialize listener
 	StatPORT           // invalid port specified
 	StatEXCP           // exception (panic) occured
+	StatSTOP           // server shut down
 )
 
 // Status handler.
@@ -0,0 +1,214 @@
+//go:build !tinygo
+
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Error messages
+var (
+	errNoPins = errors.New("no pinned certificates")
+	errPinned = errors.New("peer certificate not pinned")
+	errNoCert = errors.New("no certificate")
+)
+
+// TLSConfig for an encrypted 9p transport. Peers are authenticated by
+// pinned certificates instead of certificate chains: either certificates
+// and fingerprints are configured explicitly or both sides derive the
+// same certificate from a pre-shared key (crypto/tls has no PSK cipher
+// suites). TLS is not available in TinyGo builds (ListenTLS fails).
+type TLSConfig struct {
+	Cert *tls.Certificate // own certificate (required for servers)
+	Pins [][32]byte       // fingerprints of accepted peer certificates
+	PSK  []byte           // pre-shared key (replaces Cert and Pins)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a (DER encoded)
+// certificate used for pinning.
+func Fingerprint(cert []byte) [32]byte {
+	return sha256.Sum256(cert)
+}
+
+// Server returns the TLS configuration for a server. Clients must present
+// a pinned certificate if pins are configured.
+func (cfg *TLSConfig) Server() (*tls.Config, error) {
+	cert, pins, err := cfg.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, errNoCert
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	if len(pins) > 0 {
+		tc.ClientAuth = tls.RequireAnyClientCert
+		tc.VerifyPeerCertificate = verifyPins(pins)
+	}
+	return tc, nil
+}
+
+// Client returns the TLS configuration for a client: the server must
+// present a pinned certificate.
+func (cfg *TLSConfig) Client() (*tls.Config, error) {
+	cert, pins, err := cfg.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) == 0 {
+		return nil, errNoPins
+	}
+	tc := &tls.Config{
+		// chain verification is replaced by pinning
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPins(pins),
+		MinVersion:            tls.VersionTLS13,
+	}
+	if cert != nil {
+		tc.Certificates = []tls.Certificate{*cert}
+	}
+	return tc, nil
+}
+
+// resolve the own certificate and pinned fingerprints of a configuration.
+func (cfg *TLSConfig) resolve() (*tls.Certificate, [][32]byte, error) {
+	if cfg.PSK == nil {
+		return cfg.Cert, cfg.Pins, nil
+	}
+	cert, err := pskCertificate(cfg.PSK)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, [][32]byte{Fingerprint(cert.Certificate[0])}, nil
+}
+
+// verifyPins returns a function that accepts pinned peer certificates.
+func verifyPins(pins [][32]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 || !slices.Contains(pins, Fingerprint(raw[0])) {
+			return errPinned
+		}
+		return nil
+	}
+}
+
+// ListenTLS wraps a listener (like the one returned by Device.SetupListener)
+// so connections are encrypted with TLS. The TLS handshake is performed
+// on the first read from an accepted connection (in the goroutine serving
+// it): connections failing the handshake (like clients with unknown
+// certificates) fail on read.
+func ListenTLS(lst net.Listener, cfg *TLSConfig) (net.Listener, error) {
+	tc, err := cfg.Server()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsListener{Listener: lst, cfg: tc}, nil
+}
+
+// time limit for a TLS handshake
+const tlsTimeout = 10 * time.Second
+
+// tlsListener accepts TLS connections.
+type tlsListener struct {
+	net.Listener
+	cfg *tls.Config
+}
+
+// Accept the next connection; the handshake is deferred to the first read.
+func (l *tlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsConn{Conn: tls.Server(c, l.cfg)}, nil
+}
+
+// tlsConn is a server-side TLS connection with a time limit for the
+// handshake.
+type tlsConn struct {
+	*tls.Conn
+	once sync.Once // perform handshake once
+	err  error     // handshake result
+}
+
+// Read from the connection; the first read performs the handshake.
+func (c *tlsConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsTimeout)
+		defer cancel()
+		c.err = c.HandshakeContext(ctx)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+//----------------------------------------------------------------------
+
+// pskCertificate derives a self-signed certificate from a pre-shared key:
+// all parties knowing the key derive the same certificate.
+func pskCertificate(psk []byte) (*tls.Certificate, error) {
+	seed, err := hkdf.Key(sha256.New, psk, nil, "srv9p tls psk", ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return NewCertificate(ed25519.NewKeyFromSeed(seed), "srv9p")
+}
+
+// NewCertificate returns a self-signed certificate for an Ed25519 key. The
+// certificate is deterministic and doesn't expire: it is meant to be
+// pinned by peers.
+func NewCertificate(key ed25519.PrivateKey, name string) (*tls.Certificate, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(nil, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,134 @@
+//go:build !tinygo
+
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// serveTLS serves a namespace on a local TLS listener.
+func serveTLS(t *testing.T, ns *Namespace, cfg *TLSConfig) string {
+	t.Helper()
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lst.Close() })
+	tl, err := ListenTLS(lst, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			go ns.ServeConn(c)
+		}
+	}()
+	return lst.Addr().String()
+}
+
+// dialTLS connects to a TLS server and lists the root directory.
+func dialTLS(t *testing.T, addr string, cfg *TLSConfig) error {
+	t.Helper()
+	tc, err := cfg.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, tc)
+	if err != nil {
+		return err
+	}
+	// the server verifies client certificates after the handshake
+	c := &testClient{t: t, conn: conn}
+	if err = c.version(); err != nil {
+		return err
+	}
+	if err = c.attach(0, nofid, "glenda"); err != nil {
+		return err
+	}
+	if _, _, err = c.open(0, OREAD); err != nil {
+		return err
+	}
+	_, err = c.list(0, 8192)
+	return err
+}
+
+func TestTLSPinned(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := func(seed byte) *tls.Certificate {
+		key := make([]byte, ed25519.SeedSize)
+		key[0] = seed
+		c, err := NewCertificate(ed25519.NewKeyFromSeed(key), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	srv, cli, other := cert(1), cert(2), cert(3)
+	addr := serveTLS(t, ns, &TLSConfig{
+		Cert: srv,
+		Pins: [][32]byte{Fingerprint(cli.Certificate[0])},
+	})
+	pin := [][32]byte{Fingerprint(srv.Certificate[0])}
+	if err = dialTLS(t, addr, &TLSConfig{Cert: cli, Pins: pin}); err != nil {
+		t.Fatal(err)
+	}
+	if err = dialTLS(t, addr, &TLSConfig{Cert: other, Pins: pin}); err == nil {
+		t.Fatal("client with unknown certificate accepted")
+	}
+	pin = [][32]byte{Fingerprint(other.Certificate[0])}
+	if err = dialTLS(t, addr, &TLSConfig{Cert: cli, Pins: pin}); err == nil {
+		t.Fatal("server with unknown certificate accepted")
+	}
+}
+
+func TestTLSPSK(t *testing.T) {
+	ns, err := newNamespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, ns, &TLSConfig{PSK: []byte("shared secret")})
+
+	// a silent peer doesn't block other clients
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	if err = dialTLS(t, addr, &TLSConfig{PSK: []byte("shared secret")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = dialTLS(t, addr, &TLSConfig{PSK: []byte("guessed secret")}); err == nil {
+		t.Fatal("client with wrong key accepted")
+	}
+}
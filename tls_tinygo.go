@@ -0,0 +1,48 @@
+//go:build tinygo
+
+//----------------------------------------------------------------------
+// This file is part of srv9p.
+// Copyright (C) 2024-present Bernd Fix   >Y<
+//
+// srv9p is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// srv9p is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// SPDX-License-Identifier: AGPL3.0-or-later
+//----------------------------------------------------------------------
+
+package srv9p
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// Error messages
+var (
+	errNoTLS = errors.New("TLS not supported on this device")
+)
+
+// TLSConfig for an encrypted 9p transport (see the host build). TLS is
+// not available in TinyGo builds: ListenTLS always fails, so a device
+// never falls back to serve plain 9p when TLS was requested.
+type TLSConfig struct {
+	Cert *tls.Certificate // own certificate (required for servers)
+	Pins [][32]byte       // fingerprints of accepted peer certificates
+	PSK  []byte           // pre-shared key (replaces Cert and Pins)
+}
+
+// ListenTLS is not supported on devices and returns an error.
+func ListenTLS(lst net.Listener, cfg *TLSConfig) (net.Listener, error) {
+	return nil, errNoTLS
+}